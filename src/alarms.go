@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// alarmSeverities codes the alarm statuses by severity
+var alarmSeverities = map[types.ManagedEntityStatus]int64{
+	types.ManagedEntityStatusGray:   0,
+	types.ManagedEntityStatusGreen:  0,
+	types.ManagedEntityStatusYellow: 1,
+	types.ManagedEntityStatusRed:    2,
+}
+
+// alarmPoints returns an alarm point per triggered alarm, tagged with its entity and alarm name
+func alarmPoints(ctx context.Context, pc *property.Collector, states []types.AlarmState, config Configuration, vcTags map[string]string) ([]*influxclient.Point, error) {
+	if len(states) == 0 {
+		return nil, nil
+	}
+
+	alarmRefs := []types.ManagedObjectReference{}
+	entityRefs := []types.ManagedObjectReference{}
+	seen := make(map[types.ManagedObjectReference]bool)
+	for _, state := range states {
+		if !seen[state.Alarm] {
+			seen[state.Alarm] = true
+			alarmRefs = append(alarmRefs, state.Alarm)
+		}
+		if !seen[state.Entity] {
+			seen[state.Entity] = true
+			entityRefs = append(entityRefs, state.Entity)
+		}
+	}
+
+	var alarms []mo.Alarm
+	err := pc.Retrieve(ctx, alarmRefs, []string{"info"}, &alarms)
+	if err != nil {
+		return nil, err
+	}
+	alarmNames := make(map[types.ManagedObjectReference]string)
+	for _, alarm := range alarms {
+		alarmNames[alarm.Self] = alarm.Info.Name
+	}
+
+	var entities []mo.ManagedEntity
+	err = pc.Retrieve(ctx, entityRefs, []string{"name"}, &entities)
+	if err != nil {
+		return nil, err
+	}
+	entityNames := make(map[types.ManagedObjectReference]string)
+	for _, entity := range entities {
+		entityNames[entity.Self] = strings.ToLower(config.stripName(entity.Name))
+	}
+
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, state := range states {
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["name"] = entityNames[state.Entity]
+		tags["type"] = strings.ToLower(state.Entity.Type)
+		tags["alarm"] = alarmNames[state.Alarm]
+		tags["status"] = string(state.OverallStatus)
+		fields := map[string]interface{}{
+			"severity":     alarmSeverities[state.OverallStatus],
+			"acknowledged": boolValue(state.Acknowledged),
+		}
+		pt, err := influxclient.NewPoint("alarm", tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// AuditLog appends a compact JSON record per vCenter cycle, without the metric values
+type AuditLog struct {
+	file *RotatingFile
+}
+
+// auditRecord sums up what a vCenter cycle wrote
+type auditRecord struct {
+	Time         time.Time      `json:"time"`
+	VCenter      string         `json:"vcenter"`
+	Databases    []string       `json:"databases"`
+	Points       int            `json:"points"`
+	Measurements map[string]int `json:"measurements"`
+	Success      bool           `json:"success"`
+}
+
+// OpenAuditLog opens the audit log, rotated like the log file
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := OpenRotatingFile(path, 100*1024*1024, 5)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record appends the record of a vCenter cycle
+func (audit *AuditLog) Record(vcName string, config Configuration, status *CollectorStatus) {
+	seen := make(map[string]bool)
+	databases := []string{}
+	points := 0
+	for measurement, count := range status.Measurements {
+		points += count
+		database := config.database(measurement)
+		if !seen[database] {
+			seen[database] = true
+			databases = append(databases, database)
+		}
+	}
+	sort.Strings(databases)
+
+	record, err := json.Marshal(auditRecord{
+		Time:         time.Now(),
+		VCenter:      vcName,
+		Databases:    databases,
+		Points:       points,
+		Measurements: status.Measurements,
+		Success:      status.Success,
+	})
+	if err != nil {
+		errlog.Println("Could not encode the audit record of vcenter: ", vcName)
+		return
+	}
+	_, err = audit.file.Write(append(record, '\n'))
+	if err != nil {
+		errlog.Println("Could not write the audit record of vcenter: ", vcName)
+		errlog.Println("Error: ", err)
+	}
+}
+
+// Close closes the audit log
+func (audit *AuditLog) Close() error {
+	return audit.file.Close()
+}
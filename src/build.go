@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// hostBuildPoints returns a host_build point per host with its ESXi build number, tagged with its version
+func hostBuildPoints(hsmo []mo.HostSystem, config Configuration, vcTags map[string]string) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, host := range hsmo {
+		product := host.Summary.Config.Product
+		if product == nil {
+			continue
+		}
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["name"] = strings.ToLower(config.stripName(host.Summary.Config.Name))
+		tags["version"] = product.Version
+		fields := make(map[string]interface{})
+		// The build number grows with every patch, so it is kept numeric to compare hosts
+		if build, err := strconv.ParseInt(product.Build, 10, 64); err == nil {
+			fields["build"] = build
+		}
+		pt, err := influxclient.NewPoint("host_build", tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
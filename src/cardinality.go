@@ -0,0 +1,61 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// cardinalityPatterns match the unique identifiers commonly embedded in datastore and instance names
+var cardinalityPatterns = map[string]string{
+	"uuid": `[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}`,
+	"naa":  `(?i)\b(naa|eui|t10)\.[0-9a-z_.]+`,
+	"hex":  `[0-9a-fA-F]{16,}`,
+}
+
+// compileCardinalityReduction compiles the patterns of the tags to reduce. A pattern is either the name of a
+// built-in pattern, whose matches are replaced by <name>, or a regular expression, whose matches are replaced by <id>.
+func compileCardinalityReduction(reduction map[string][]string) (map[string][]TagValueRewrite, error) {
+	rules := make(map[string][]TagValueRewrite)
+	for key, patterns := range reduction {
+		for _, pattern := range patterns {
+			rule := TagValueRewrite{Pattern: pattern, Replacement: "<id>"}
+			if builtin, ok := cardinalityPatterns[pattern]; ok {
+				rule = TagValueRewrite{Pattern: builtin, Replacement: "<" + pattern + ">"}
+			}
+			var err error
+			rule.pattern, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			rules[key] = append(rules[key], rule)
+		}
+	}
+	return rules, nil
+}
+
+// reduceCardinality replaces the unique identifiers of the tag values with placeholders, and logs per tag how many
+// distinct values were collapsed into how many, so the impact of the reduction is visible
+func reduceCardinality(points []*influxclient.Point, rules map[string][]TagValueRewrite, vcName string) []*influxclient.Point {
+	from := make(map[string]map[string]bool)
+	to := make(map[string]map[string]bool)
+	points = rewriteTags(points, rules, func(key, original, value string) {
+		if from[key] == nil {
+			from[key] = make(map[string]bool)
+			to[key] = make(map[string]bool)
+		}
+		from[key][original] = true
+		to[key][value] = true
+	})
+
+	keys := []string{}
+	for key := range from {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		stdlog.Println("Reduced ", len(from[key]), " values of tag ", key, " to ", len(to[key]), " on vcenter: ", vcName)
+	}
+	return points
+}
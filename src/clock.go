@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"golang.org/x/net/context"
+)
+
+// clockSkew returns how far the clock of the vCenter is ahead of the collector's, compared to the middle of the call
+func clockSkew(ctx context.Context, client *vim25.Client) (time.Duration, error) {
+	before := time.Now()
+	vcTime, err := methods.GetCurrentTime(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+	return vcTime.Sub(before.Add(after.Sub(before) / 2)), nil
+}
+
+// checkClockSkew warns when the clock skew measured at connect time exceeds maxSkew seconds, 5 by default
+func (vcenter *VCenter) checkClockSkew(maxSkew int) {
+	if !vcenter.skewMeasured {
+		return
+	}
+	vcenter.skewMeasured = false
+	if maxSkew <= 0 {
+		maxSkew = 5
+	}
+	skew := vcenter.clockSkew
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(maxSkew)*time.Second {
+		errlog.Println("Warning: the clock of vcenter ", vcenter.Hostname, " is ", vcenter.clockSkew, " off the collector's, performance queries may miss samples")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// ContentLibrary sums up the items of a content library
+type ContentLibrary struct {
+	Name      string
+	Type      string
+	Items     int64
+	Templates int64
+	Size      int64
+}
+
+// ContentLibraries returns the content libraries with their item counts and sizes
+func (rest *RestClient) ContentLibraries() ([]ContentLibrary, error) {
+	var libraryIDs []string
+	err := rest.do("GET", "/com/vmware/content/library", nil, &libraryIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	libraries := []ContentLibrary{}
+	for _, libraryID := range libraryIDs {
+		var library struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}
+		err = rest.do("GET", "/com/vmware/content/library/id:"+libraryID, nil, &library)
+		if err != nil {
+			return nil, err
+		}
+		var itemIDs []string
+		err = rest.do("GET", "/com/vmware/content/library/item?library_id="+url.QueryEscape(libraryID), nil, &itemIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		summary := ContentLibrary{Name: library.Name, Type: library.Type, Items: int64(len(itemIDs))}
+		for _, itemID := range itemIDs {
+			var item struct {
+				Type string `json:"type"`
+				Size int64  `json:"size"`
+			}
+			err = rest.do("GET", "/com/vmware/content/library/item/id:"+itemID, nil, &item)
+			if err != nil {
+				return nil, err
+			}
+			summary.Size += item.Size
+			if item.Type == "ovf" || item.Type == "vm-template" {
+				summary.Templates++
+			}
+		}
+		libraries = append(libraries, summary)
+	}
+	return libraries, nil
+}
+
+// contentLibraryPoints returns a content_library point per content library with its item counts and size
+func contentLibraryPoints(vcenter *VCenter, vcTags map[string]string) ([]*influxclient.Point, error) {
+	rest, err := NewRestClient(vcenter)
+	if err != nil {
+		return nil, err
+	}
+	defer rest.Logout()
+
+	libraries, err := rest.ContentLibraries()
+	if err != nil {
+		return nil, err
+	}
+
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, library := range libraries {
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["library"] = library.Name
+		tags["type"] = library.Type
+		fields := map[string]interface{}{
+			"item_count":     library.Items,
+			"template_count": library.Templates,
+			"size":           library.Size,
+		}
+		pt, err := influxclient.NewPoint("content_library", tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
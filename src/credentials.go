@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// CredentialProvider returns the credentials to log in to a vCenter
+type CredentialProvider interface {
+	GetCredentials(vcenter string) (user, pass string, err error)
+}
+
+// ConfigCredentials returns the credentials of a vCenter from its configuration, an environment variable or a file
+type ConfigCredentials struct {
+	Username     string
+	Password     string
+	PasswordEnv  string
+	PasswordFile string
+}
+
+// GetCredentials returns the inline password, else the one of the environment variable, else the one of the file.
+// The file is read at every call so rotated passwords are picked up.
+func (credentials ConfigCredentials) GetCredentials(vcenter string) (string, string, error) {
+	if credentials.Password != "" {
+		return credentials.Username, credentials.Password, nil
+	}
+	if credentials.PasswordEnv != "" {
+		if password := os.Getenv(credentials.PasswordEnv); password != "" {
+			return credentials.Username, password, nil
+		}
+	}
+	if credentials.PasswordFile != "" {
+		password, err := readPasswordFile(credentials.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		return credentials.Username, password, nil
+	}
+	return credentials.Username, "", nil
+}
+
+// Vault is used to fetch the vCenter credentials from a HashiCorp Vault KV secret
+type Vault struct {
+	Address     string
+	Token       string
+	TokenFile   string
+	Path        string
+	UsernameKey string
+	PasswordKey string
+}
+
+// VaultCredentials fetches the credentials of the vCenters from Vault at every login
+type VaultCredentials struct {
+	config Vault
+	client *http.Client
+}
+
+// NewVaultCredentials returns a Vault credential provider, defaulting to the VAULT_ADDR and VAULT_TOKEN variables
+func NewVaultCredentials(config Vault) *VaultCredentials {
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+	}
+	if config.UsernameKey == "" {
+		config.UsernameKey = "username"
+	}
+	if config.PasswordKey == "" {
+		config.PasswordKey = "password"
+	}
+	return &VaultCredentials{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// token returns the Vault token, read at every call so renewed tokens are picked up
+func (vault *VaultCredentials) token() (string, error) {
+	if vault.config.Token != "" {
+		return vault.config.Token, nil
+	}
+	if vault.config.TokenFile != "" {
+		return readPasswordFile(vault.config.TokenFile)
+	}
+	return os.Getenv("VAULT_TOKEN"), nil
+}
+
+// GetCredentials reads the secret at the configured path, where {vcenter} is replaced by the vCenter hostname.
+// Both the KV version 1 and version 2 secret engines are supported.
+func (vault *VaultCredentials) GetCredentials(vcenter string) (string, string, error) {
+	token, err := vault.token()
+	if err != nil {
+		return "", "", err
+	}
+	path := strings.Replace(vault.config.Path, "{vcenter}", vcenter, -1)
+	req, err := http.NewRequest("GET", strings.TrimSuffix(vault.config.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := vault.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.New("vault returned " + resp.Status + " for secret " + path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&secret)
+	if err != nil {
+		return "", "", err
+	}
+	data := secret.Data
+	// KV version 2 nests the secret in its own data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	username, _ := data[vault.config.UsernameKey].(string)
+	password, ok := data[vault.config.PasswordKey].(string)
+	if !ok {
+		return "", "", errors.New("vault secret " + path + " has no " + vault.config.PasswordKey + " key")
+	}
+	return username, password, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// DatastoreFallback aggregates the per datastore counters of the hosts, for when datastore counters are not collected
+type DatastoreFallback struct {
+	sums   map[string]map[string]int64
+	counts map[string]map[string]int64
+}
+
+// NewDatastoreFallback returns an empty aggregation
+func NewDatastoreFallback() *DatastoreFallback {
+	return &DatastoreFallback{sums: make(map[string]map[string]int64), counts: make(map[string]map[string]int64)}
+}
+
+// Add accounts the value of a host counter for the datastore of its instance
+func (fallback *DatastoreFallback) Add(instance string, field string, value int64) {
+	if value < 0 {
+		return
+	}
+	if fallback.sums[instance] == nil {
+		fallback.sums[instance] = make(map[string]int64)
+		fallback.counts[instance] = make(map[string]int64)
+	}
+	fallback.sums[instance][field] += value
+	fallback.counts[instance][field]++
+}
+
+// Empty tells if no host counter was accounted
+func (fallback *DatastoreFallback) Empty() bool {
+	return len(fallback.sums) == 0
+}
+
+// Points returns a point per datastore. The latencies are averaged over the hosts and the other counters,
+// such as the IOPS, summed: the result approximates the counters of the datastore itself.
+func (fallback *DatastoreFallback) Points(names map[string]string, config Configuration, vcTags map[string]string, now time.Time) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	for instance, sums := range fallback.sums {
+		name, ok := names[instance]
+		if !ok {
+			continue
+		}
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["name"] = strings.ToLower(config.stripName(name))
+		tags["source"] = "host"
+		fields := make(map[string]interface{})
+		for field, sum := range sums {
+			if strings.Contains(field, "latency") {
+				fields[field] = sum / fallback.counts[instance][field]
+			} else {
+				fields[field] = sum
+			}
+		}
+		pt, err := influxclient.NewPoint(config.measurementName("Datastore", "datastore"), tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
+
+// datastoreNames returns the names of the datastores mounted on the hosts by their UUID, the instance of host counters
+func datastoreNames(ctx context.Context, pc *property.Collector, hsmo []mo.HostSystem) (map[string]string, error) {
+	seen := make(map[types.ManagedObjectReference]bool)
+	refs := []types.ManagedObjectReference{}
+	for _, host := range hsmo {
+		for _, ref := range host.Datastore {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	names := make(map[string]string)
+	if len(refs) == 0 {
+		return names, nil
+	}
+
+	var dsmo []mo.Datastore
+	err := pc.Retrieve(ctx, refs, []string{"summary.name", "summary.url"}, &dsmo)
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range dsmo {
+		// The URL ends with the UUID of the datastore, e.g. ds:///vmfs/volumes/5a1b2c3d-.../
+		names[path.Base(strings.TrimSuffix(ds.Summary.Url, "/"))] = ds.Summary.Name
+	}
+	return names, nil
+}
+
+// datastoreCapacityPoints returns a datastore point per datastore with its capacity, free, used and provisioned
+// space (bytes), its usage_percent and provisioned_percent, and its vm_count. The provisioned space adds the space
+// thin-provisioned disks may still grow into. Inaccessible datastores report no capacity, so their percentages are left out.
+func datastoreCapacityPoints(ctx context.Context, pc *property.Collector, datastoreRefs []types.ManagedObjectReference, config Configuration, vcTags map[string]string) ([]*influxclient.Point, error) {
+	var dsmo []mo.Datastore
+	err := pc.Retrieve(ctx, datastoreRefs, []string{"summary", "vm"}, &dsmo)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, ds := range dsmo {
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["name"] = strings.ToLower(config.stripName(ds.Summary.Name))
+		tags["type"] = ds.Summary.Type
+		provisioned := ds.Summary.Capacity - ds.Summary.FreeSpace + ds.Summary.Uncommitted
+		fields := map[string]interface{}{
+			"capacity":          ds.Summary.Capacity,
+			"free_space":        ds.Summary.FreeSpace,
+			"used_space":        ds.Summary.Capacity - ds.Summary.FreeSpace,
+			"provisioned_space": provisioned,
+			"vm_count":          int64(len(ds.Vm)),
+			"accessible":        ds.Summary.Accessible,
+		}
+		if ds.Summary.Accessible && ds.Summary.Capacity > 0 {
+			fields["usage_percent"] = float64(ds.Summary.Capacity-ds.Summary.FreeSpace) / float64(ds.Summary.Capacity) * 100
+			fields["provisioned_percent"] = float64(provisioned) / float64(ds.Summary.Capacity) * 100
+		}
+		pt, err := influxclient.NewPoint("datastore", tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
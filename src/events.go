@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// stateEventTypes are the configuration, power and placement changes of the VMs and hosts written as events
+var stateEventTypes = []string{
+	"VmCreatedEvent",
+	"VmClonedEvent",
+	"VmDeployedEvent",
+	"VmRemovedEvent",
+	"VmRenamedEvent",
+	"VmReconfiguredEvent",
+	"VmPoweredOnEvent",
+	"VmPoweredOffEvent",
+	"VmSuspendedEvent",
+	"VmResettingEvent",
+	"VmGuestRebootEvent",
+	"VmGuestShutdownEvent",
+	"VmMigratedEvent",
+	"DrsVmMigratedEvent",
+	"VmRelocatedEvent",
+	"HostConnectedEvent",
+	"HostDisconnectedEvent",
+	"HostShutdownEvent",
+	"EnteredMaintenanceModeEvent",
+	"ExitMaintenanceModeEvent",
+}
+
+// eventPoints returns an events point per event newer than lastKey, stamped with the time of the event, and the
+// key of the newest event. Event keys grow with time, so the events of overlapping windows are only written once.
+func eventPoints(events []types.BaseEvent, lastKey int32, config Configuration, vcTags map[string]string) ([]*influxclient.Point, int32) {
+	points := []*influxclient.Point{}
+	newestKey := lastKey
+	for _, baseEvent := range events {
+		event := baseEvent.GetEvent()
+		if event.Key <= lastKey {
+			continue
+		}
+		if event.Key > newestKey {
+			newestKey = event.Key
+		}
+
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["event"] = reflect.Indirect(reflect.ValueOf(baseEvent)).Type().Name()
+		if event.Vm != nil {
+			tags["name"] = strings.ToLower(config.stripName(event.Vm.Name))
+			tags["type"] = "vm"
+			if event.Host != nil {
+				tags[config.esxTagKey()] = event.Host.Name
+			}
+		} else if event.Host != nil {
+			tags["name"] = strings.ToLower(config.stripName(event.Host.Name))
+			tags["type"] = "host"
+		}
+		if event.ComputeResource != nil {
+			tags["cluster"] = event.ComputeResource.Name
+		}
+
+		fields := map[string]interface{}{
+			"key":     int64(event.Key),
+			"message": event.FullFormattedMessage,
+			"user":    event.UserName,
+		}
+		pt, err := influxclient.NewPoint("events", tags, fields, event.CreatedTime)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, newestKey
+}
+
+// eventWindow returns the window to read the events of a cycle from. It overlaps the previous window by a minute
+// so events logged late are not missed, or looks back one interval, or one minute for single runs, at first.
+func eventWindow(last time.Time, interval int) (time.Time, time.Time) {
+	end := time.Now()
+	if !last.IsZero() {
+		return last.Add(-time.Minute), end
+	}
+	if interval > 0 {
+		return end.Add(-time.Duration(interval) * time.Second), end
+	}
+	return end.Add(-time.Minute), end
+}
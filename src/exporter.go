@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// Exporter is used to serve the metrics to Prometheus scrapes instead of pushing them
+type Exporter struct {
+	ListenAddress string
+	Path          string
+	MinRefresh    int
+}
+
+// captureOutput keeps the points written during a collection
+type captureOutput struct {
+	mutex  sync.Mutex
+	points []*influxclient.Point
+}
+
+// Write keeps the points of the batch
+func (output *captureOutput) Write(bp influxclient.BatchPoints) error {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.points = append(output.points, bp.Points()...)
+	return nil
+}
+
+// Close does nothing as the points are only kept in memory
+func (output *captureOutput) Close() error {
+	return nil
+}
+
+// PrometheusExporter collects the vCenters on scrape, reusing the last collection for MinRefresh seconds
+type PrometheusExporter struct {
+	config     Configuration
+	minRefresh time.Duration
+
+	mutex       sync.Mutex
+	lastCollect time.Time
+	points      []*influxclient.Point
+}
+
+// NewPrometheusExporter creates the exporter, refreshing at most every Interval seconds by default
+func NewPrometheusExporter(config Configuration) *PrometheusExporter {
+	minRefresh := config.Exporter.MinRefresh
+	if minRefresh <= 0 {
+		minRefresh = config.Interval
+	}
+	if minRefresh <= 0 {
+		minRefresh = 60
+	}
+	return &PrometheusExporter{config: config, minRefresh: time.Duration(minRefresh) * time.Second}
+}
+
+// collect returns the points of the last collection, collecting again when they are too old.
+// Concurrent scrapes wait for the running collection instead of starting their own.
+func (exporter *PrometheusExporter) collect() []*influxclient.Point {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	if exporter.points != nil && time.Since(exporter.lastCollect) < exporter.minRefresh {
+		return exporter.points
+	}
+
+	output := &captureOutput{}
+	writeConfigFingerprint(exporter.config, output)
+	for _, vcenter := range exporter.config.VCenters {
+		queryVCenter(vcenter, exporter.config, output)
+	}
+	exporter.points = output.points
+	exporter.lastCollect = time.Now()
+	return exporter.points
+}
+
+// ServeHTTP answers a scrape in the OpenMetrics format when accepted, in the Prometheus text format otherwise
+func (exporter *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	body := exposition(exporter.collect(), openMetrics)
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.Write(body)
+}
+
+// exposition formats the points as gauges, one metric per measurement and numeric field, with the tags as labels
+func exposition(points []*influxclient.Point, openMetrics bool) []byte {
+	series := make(map[string][]string)
+	for _, pt := range points {
+		fields, err := pt.Fields()
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		labels := []string{}
+		for key, tag := range pt.Tags() {
+			labels = append(labels, prometheusName(key)+"=\""+escapeLabelValue(tag)+"\"")
+		}
+		sort.Strings(labels)
+		for field, value := range fields {
+			number, ok := prometheusValue(value)
+			if !ok {
+				continue
+			}
+			name := prometheusName(pt.Name() + "_" + field)
+			series[name] = append(series[name], name+"{"+strings.Join(labels, ",")+"} "+strconv.FormatFloat(number, 'g', -1, 64))
+		}
+	}
+
+	names := []string{}
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&body, "# TYPE %s gauge\n", name)
+		for _, line := range series[name] {
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+	}
+	if openMetrics {
+		body.WriteString("# EOF\n")
+	}
+	return body.Bytes()
+}
+
+// escapeLabelValue escapes the backslashes, double quotes and line feeds of a label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// serveExporter serves the metrics to Prometheus scrapes until the server fails
+func serveExporter(config Configuration) {
+	path := config.Exporter.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, NewPrometheusExporter(config))
+	stdlog.Println("Serving metrics on ", config.Exporter.ListenAddress, path)
+	errlog.Fatalln(http.ListenAndServe(config.Exporter.ListenAddress, mux))
+}
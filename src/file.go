@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// FileOutput appends points as newline-delimited records to a rotated file, JSON records by default
+type FileOutput struct {
+	file       *RotatingFile
+	serializer Serializer
+}
+
+// NewFileOutput opens the file of a file output from its configuration
+func NewFileOutput(config OutputConfig) (*FileOutput, error) {
+	serializer, err := NewSerializer(config)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := config.MaxSize
+	if maxSize == 0 {
+		maxSize = 100
+	}
+	file, err := OpenRotatingFile(config.Path, int64(maxSize)*1024*1024, config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOutput{file: file, serializer: serializer}, nil
+}
+
+// Write appends the points of a cycle in a single write, so a rotation never splits them
+func (output *FileOutput) Write(bp influxclient.BatchPoints) error {
+	var records bytes.Buffer
+	for _, pt := range bp.Points() {
+		record, err := output.serializer.Serialize(pt)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		records.Write(record)
+	}
+	_, err := output.file.Write(records.Bytes())
+	return err
+}
+
+// Close closes the file
+func (output *FileOutput) Close() error {
+	return output.file.Close()
+}
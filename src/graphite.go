@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// GraphiteOutput writes points to a carbon endpoint using the plaintext protocol
+type GraphiteOutput struct {
+	Address    string
+	serializer Serializer
+}
+
+// graphiteSerializer writes a point as a plaintext line per numeric field, for carbon or for the text outputs
+type graphiteSerializer struct {
+	Prefix   string
+	TagOrder []string
+	Tagged   bool
+	format   lineProtocol
+}
+
+// NewGraphiteOutput creates a Graphite output from its configuration
+func NewGraphiteOutput(config OutputConfig) (*GraphiteOutput, error) {
+	serializer, err := NewSerializer(config)
+	if err != nil {
+		return nil, err
+	}
+	port := config.Port
+	if port == 0 {
+		port = 2003
+	}
+	return &GraphiteOutput{
+		Address:    net.JoinHostPort(config.Hostname, strconv.Itoa(port)),
+		serializer: serializer,
+	}, nil
+}
+
+// Write sends the points to carbon, one line per numeric field
+func (output *GraphiteOutput) Write(bp influxclient.BatchPoints) error {
+	conn, err := net.DialTimeout("tcp", output.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	for _, pt := range bp.Points() {
+		lines, err := output.serializer.Serialize(pt)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		_, err = writer.Write(lines)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// Close does nothing as connections are opened per write
+func (output *GraphiteOutput) Close() error {
+	return nil
+}
+
+// Serialize returns the lines of the numeric fields of the point
+func (serializer graphiteSerializer) Serialize(pt *influxclient.Point) ([]byte, error) {
+	fields, err := pt.Fields()
+	if err != nil {
+		return nil, err
+	}
+	var lines []byte
+	for field, value := range fields {
+		formatted, ok := serializer.value(value)
+		if !ok {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d\n", serializer.path(pt, field), formatted, pt.Time().Unix())...)
+	}
+	return lines, nil
+}
+
+// path builds the metric path of a field, mapping tags into the path or into carbon tags
+func (serializer graphiteSerializer) path(pt *influxclient.Point, field string) string {
+	tags := pt.Tags()
+	parts := []string{}
+	if serializer.Prefix != "" {
+		parts = append(parts, serializer.Prefix)
+	}
+	parts = append(parts, graphiteEscape(pt.Name()))
+
+	if serializer.Tagged {
+		parts = append(parts, graphiteEscape(field))
+		keys := []string{}
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		path := strings.Join(parts, ".")
+		for _, key := range keys {
+			if tags[key] != "" {
+				path += ";" + graphiteEscape(key) + "=" + graphiteEscape(tags[key])
+			}
+		}
+		return path
+	}
+
+	order := serializer.TagOrder
+	if len(order) == 0 {
+		for key := range tags {
+			order = append(order, key)
+		}
+		sort.Strings(order)
+	}
+	for _, key := range order {
+		if tags[key] != "" {
+			parts = append(parts, graphiteEscape(tags[key]))
+		}
+	}
+	parts = append(parts, graphiteEscape(field))
+	return strings.Join(parts, ".")
+}
+
+// graphiteEscape replaces the characters that have a meaning in a Graphite path
+func graphiteEscape(value string) string {
+	return strings.NewReplacer(".", "_", " ", "_", ";", "_", "/", "_", "=", "_").Replace(value)
+}
+
+// value formats a field value, Graphite only supports numbers
+func (serializer graphiteSerializer) value(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return serializer.format.float(v)
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+)
+
+// InstanceCap bounds the number of instances written per entity and measurement
+type InstanceCap struct {
+	Max          int
+	Measurements map[string]int
+	Keep         string
+	SortField    string
+	Rest         string
+}
+
+// max returns the maximum number of instances of a measurement, 0 when unbounded
+func (instanceCap InstanceCap) max(measurement string) int {
+	if max, ok := instanceCap.Measurements[measurement]; ok {
+		return max
+	}
+	return instanceCap.Max
+}
+
+// capInstances keeps at most max instances of an entity, the first ones by name or the top ones by SortField,
+// and drops the rest or sums it into an "other" instance. The aggregate instance, without name, is always kept.
+// It returns the number of instances removed.
+func (instanceCap InstanceCap) capInstances(fields map[string]map[string]interface{}, tags map[string]map[string]string, max int) int {
+	keys := []string{}
+	for key := range fields {
+		if tags[key]["instance"] != "" {
+			keys = append(keys, key)
+		}
+	}
+	if max <= 0 || len(keys) <= max {
+		return 0
+	}
+
+	sort.Strings(keys)
+	if instanceCap.Keep == "top" {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return instanceValue(fields[keys[i]], instanceCap.SortField) > instanceValue(fields[keys[j]], instanceCap.SortField)
+		})
+	}
+
+	rest := keys[max:]
+	var other map[string]interface{}
+	var otherTags map[string]string
+	if instanceCap.Rest == "other" {
+		other = make(map[string]interface{})
+		otherTags = make(map[string]string)
+		for k, v := range tags[rest[0]] {
+			otherTags[k] = v
+		}
+		otherTags["instance"] = "other"
+	}
+	for _, key := range rest {
+		if other != nil {
+			for field, value := range fields[key] {
+				switch v := value.(type) {
+				case int64:
+					sum, _ := other[field].(int64)
+					other[field] = sum + v
+				case float64:
+					sum, _ := other[field].(float64)
+					other[field] = sum + v
+				}
+			}
+		}
+		delete(fields, key)
+		delete(tags, key)
+	}
+	if len(other) > 0 {
+		fields["other"] = other
+		tags["other"] = otherTags
+	}
+	return len(rest)
+}
+
+// instanceValue returns the value an instance is ranked by: its sort field, or its first numeric field by name
+func instanceValue(fields map[string]interface{}, sortField string) float64 {
+	if sortField == "" {
+		names := []string{}
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := prometheusValue(fields[name]); ok {
+				return value
+			}
+		}
+		return 0
+	}
+	value, _ := prometheusValue(fields[sortField])
+	return value
+}
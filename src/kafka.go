@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// Kafka protocol API keys and the versions used, supported by the brokers since Kafka 0.11
+const (
+	kafkaProduceKey      = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadataKey     = 3
+	kafkaMetadataVersion = 1
+	// Size of the record batches, below the default message size limit of the brokers
+	kafkaMaxBatchSize = 512 * 1024
+	// Largest response accepted from a broker, far above the metadata and produce responses of the collector
+	kafkaMaxResponseSize = 16 * 1024 * 1024
+)
+
+// castagnoli is the CRC-32C table of the record batch checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaOutput publishes points to a Kafka topic, one message per point.
+// Writes are synchronous and acknowledged by the partition leaders, so nothing is left to flush on shutdown.
+// The broker connections are kept between writes, and dropped when a request over them fails.
+type KafkaOutput struct {
+	Brokers []string
+	Topic   string
+	Key     string
+	Format  string
+
+	serializer    Serializer
+	correlationID int32
+	mutex         sync.Mutex
+	conns         map[string]net.Conn
+}
+
+// kafkaRecord is a message to publish
+type kafkaRecord struct {
+	key       []byte
+	value     []byte
+	timestamp int64
+}
+
+// NewKafkaOutput creates a Kafka output from its configuration
+func NewKafkaOutput(config OutputConfig) (*KafkaOutput, error) {
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, errors.New("kafka output requires Brokers and a Topic")
+	}
+	format, err := outputFormat(config)
+	if err != nil {
+		return nil, err
+	}
+	serializer, err := NewSerializer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaOutput{
+		Brokers:    config.Brokers,
+		Topic:      config.Topic,
+		Key:        config.Key,
+		Format:     format,
+		serializer: serializer,
+		conns:      make(map[string]net.Conn),
+	}, nil
+}
+
+// Write publishes the points, keyed by measurement or by the configured tag so related points share a partition
+func (output *KafkaOutput) Write(bp influxclient.BatchPoints) error {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	// The leaders are read at every write to follow partition reassignments
+	leaders, err := output.metadata()
+	if err != nil {
+		return err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("kafka topic %s has no partitions", output.Topic)
+	}
+
+	records := make(map[int32][]kafkaRecord)
+	for _, pt := range bp.Points() {
+		record, err := output.record(pt)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		partition := kafkaPartition(record.key, len(leaders))
+		records[partition] = append(records[partition], record)
+	}
+
+	// A failed partition does not stop the others, the cycle is retried as a whole so the partitions already
+	// produced are produced again: delivery is at least once
+	var lastErr error
+	for partition, partitionRecords := range records {
+		err = output.producePartition(leaders[partition], partition, partitionRecords)
+		if err != nil {
+			errlog.Println("Could not produce ", len(partitionRecords), " records to kafka partition ", output.Topic, "/", partition)
+			errlog.Println("Error: ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// producePartition sends the records of a partition to its leader in as many record batches as needed
+func (output *KafkaOutput) producePartition(leader string, partition int32, records []kafkaRecord) error {
+	if leader == "" {
+		return fmt.Errorf("kafka partition %s/%d has no leader", output.Topic, partition)
+	}
+	for len(records) > 0 {
+		batch, rest := encodeRecordBatch(records)
+		err := output.produce(leader, partition, batch)
+		if err != nil {
+			return err
+		}
+		records = rest
+	}
+	return nil
+}
+
+// Close closes the broker connections
+func (output *KafkaOutput) Close() error {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	for address, conn := range output.conns {
+		conn.Close()
+		delete(output.conns, address)
+	}
+	return nil
+}
+
+// connect returns the connection to a broker, opening it on first use
+func (output *KafkaOutput) connect(address string) (net.Conn, error) {
+	if conn, ok := output.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	output.conns[address] = conn
+	return conn, nil
+}
+
+// kafkaPartition picks the partition of a key like the default partitioner of the Kafka clients, so the records
+// land on the same partitions as with any other producer
+func kafkaPartition(key []byte, partitions int) int32 {
+	return int32((murmur2(key) & 0x7fffffff) % uint32(partitions))
+}
+
+// murmur2 is the hash of the default partitioner of the Kafka clients
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// record encodes a point as a message
+func (output *KafkaOutput) record(pt *influxclient.Point) (kafkaRecord, error) {
+	key := pt.Name()
+	if output.Key != "" && output.Key != "measurement" {
+		key = pt.Tags()[output.Key]
+	}
+	record := kafkaRecord{key: []byte(key), timestamp: pt.Time().UnixNano() / int64(time.Millisecond)}
+	value, err := output.serializer.Serialize(pt)
+	if err != nil {
+		return record, err
+	}
+	if len(value) == 0 {
+		return record, errors.New("point " + pt.Name() + " has no field to write")
+	}
+	record.value = bytes.TrimSuffix(value, []byte("\n"))
+	return record, nil
+}
+
+// metadata returns the address of the leader of each partition of the topic, asking the brokers in turn.
+// Every partition is listed, with an empty address when it has no leader.
+func (output *KafkaOutput) metadata() (map[int32]string, error) {
+	var request bytes.Buffer
+	binary.Write(&request, binary.BigEndian, int32(1))
+	kafkaString(&request, output.Topic)
+
+	var lastErr error
+	for _, broker := range output.Brokers {
+		response, err := output.request(broker, kafkaMetadataKey, kafkaMetadataVersion, request.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		reader := &kafkaReader{data: response}
+		brokers := make(map[int32]string)
+		for i := reader.int32(); i > 0 && reader.err == nil; i-- {
+			nodeID := reader.int32()
+			host := reader.string()
+			port := reader.int32()
+			reader.string() // rack
+			brokers[nodeID] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		reader.int32() // controller
+		leaders := make(map[int32]string)
+		for i := reader.int32(); i > 0 && reader.err == nil; i-- {
+			topicError := reader.int16()
+			topic := reader.string()
+			reader.int8() // internal
+			if topicError != 0 {
+				return nil, fmt.Errorf("kafka metadata of topic %s failed with error code %d", topic, topicError)
+			}
+			for j := reader.int32(); j > 0 && reader.err == nil; j-- {
+				reader.int16() // partition error, such as a missing replica, which does not prevent producing
+				partition := reader.int32()
+				leader := reader.int32()
+				reader.int32Array() // replicas
+				reader.int32Array() // in-sync replicas
+				leaders[partition] = brokers[leader]
+			}
+		}
+		if reader.err != nil {
+			lastErr = reader.err
+			continue
+		}
+		return leaders, nil
+	}
+	return nil, lastErr
+}
+
+// produce sends a record batch to a partition, waiting for its leader to acknowledge it
+func (output *KafkaOutput) produce(leader string, partition int32, batch []byte) error {
+	var request bytes.Buffer
+	binary.Write(&request, binary.BigEndian, int16(-1)) // no transactional id
+	binary.Write(&request, binary.BigEndian, int16(1))  // leader acknowledgement
+	binary.Write(&request, binary.BigEndian, int32(30000))
+	binary.Write(&request, binary.BigEndian, int32(1))
+	kafkaString(&request, output.Topic)
+	binary.Write(&request, binary.BigEndian, int32(1))
+	binary.Write(&request, binary.BigEndian, partition)
+	binary.Write(&request, binary.BigEndian, int32(len(batch)))
+	request.Write(batch)
+
+	response, err := output.request(leader, kafkaProduceKey, kafkaProduceVersion, request.Bytes())
+	if err != nil {
+		return err
+	}
+	reader := &kafkaReader{data: response}
+	for i := reader.int32(); i > 0 && reader.err == nil; i-- {
+		topic := reader.string()
+		for j := reader.int32(); j > 0 && reader.err == nil; j-- {
+			index := reader.int32()
+			errorCode := reader.int16()
+			reader.int64() // base offset
+			reader.int64() // log append time
+			if errorCode != 0 {
+				return fmt.Errorf("kafka produce to %s/%d failed with error code %d", topic, index, errorCode)
+			}
+		}
+	}
+	return reader.err
+}
+
+// request sends a request to a broker and returns the body of its response. The connection is closed on failure,
+// as a partial exchange leaves it unusable.
+func (output *KafkaOutput) request(address string, apiKey int16, apiVersion int16, body []byte) ([]byte, error) {
+	conn, err := output.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	response, err := output.exchange(conn, apiKey, apiVersion, body)
+	if err != nil {
+		conn.Close()
+		delete(output.conns, address)
+	}
+	return response, err
+}
+
+// exchange sends a request over a connection and reads its response
+func (output *KafkaOutput) exchange(conn net.Conn, apiKey int16, apiVersion int16, body []byte) ([]byte, error) {
+	correlationID := atomic.AddInt32(&output.correlationID, 1)
+	var request bytes.Buffer
+	binary.Write(&request, binary.BigEndian, apiKey)
+	binary.Write(&request, binary.BigEndian, apiVersion)
+	binary.Write(&request, binary.BigEndian, correlationID)
+	kafkaString(&request, name)
+	request.Write(body)
+
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	err := binary.Write(conn, binary.BigEndian, int32(request.Len()))
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var size int32
+	err = binary.Read(conn, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	// The size comes from the broker, a corrupt one must neither panic nor exhaust the memory
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("kafka response size %d is out of bounds", size)
+	}
+	response := make([]byte, size)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 4 || int32(binary.BigEndian.Uint32(response)) != correlationID {
+		return nil, errors.New("kafka response does not match its request")
+	}
+	return response[4:], nil
+}
+
+// encodeRecordBatch encodes the records fitting in a record batch, returning the records left for the next ones
+func encodeRecordBatch(records []kafkaRecord) ([]byte, []kafkaRecord) {
+	baseTimestamp := records[0].timestamp
+	maxTimestamp := baseTimestamp
+	var encoded bytes.Buffer
+	count := 0
+	for _, record := range records {
+		var body bytes.Buffer
+		body.WriteByte(0) // attributes
+		kafkaVarint(&body, record.timestamp-baseTimestamp)
+		kafkaVarint(&body, int64(count))
+		kafkaVarint(&body, int64(len(record.key)))
+		body.Write(record.key)
+		kafkaVarint(&body, int64(len(record.value)))
+		body.Write(record.value)
+		kafkaVarint(&body, 0) // headers
+
+		// Always keep one record so a large one still gets its own batch
+		if count > 0 && encoded.Len()+body.Len()+binary.MaxVarintLen64 > kafkaMaxBatchSize {
+			break
+		}
+		kafkaVarint(&encoded, int64(body.Len()))
+		encoded.Write(body.Bytes())
+		if record.timestamp > maxTimestamp {
+			maxTimestamp = record.timestamp
+		}
+		count++
+	}
+
+	// The checksum covers the batch from its attributes on
+	var checked bytes.Buffer
+	binary.Write(&checked, binary.BigEndian, int16(0)) // attributes, no compression
+	binary.Write(&checked, binary.BigEndian, int32(count-1))
+	binary.Write(&checked, binary.BigEndian, baseTimestamp)
+	binary.Write(&checked, binary.BigEndian, maxTimestamp)
+	binary.Write(&checked, binary.BigEndian, int64(-1)) // producer id
+	binary.Write(&checked, binary.BigEndian, int16(-1)) // producer epoch
+	binary.Write(&checked, binary.BigEndian, int32(-1)) // base sequence
+	binary.Write(&checked, binary.BigEndian, int32(count))
+	checked.Write(encoded.Bytes())
+
+	var batch bytes.Buffer
+	binary.Write(&batch, binary.BigEndian, int64(0))                   // base offset
+	binary.Write(&batch, binary.BigEndian, int32(checked.Len()+4+1+4)) // length from the leader epoch on
+	binary.Write(&batch, binary.BigEndian, int32(-1))                  // partition leader epoch
+	batch.WriteByte(2)                                                 // magic
+	binary.Write(&batch, binary.BigEndian, crc32.Checksum(checked.Bytes(), castagnoli))
+	batch.Write(checked.Bytes())
+	return batch.Bytes(), records[count:]
+}
+
+// kafkaString writes a Kafka protocol string
+func kafkaString(buf *bytes.Buffer, value string) {
+	binary.Write(buf, binary.BigEndian, int16(len(value)))
+	buf.WriteString(value)
+}
+
+// kafkaVarint writes a zigzag encoded varint, as used in the records
+func kafkaVarint(buf *bytes.Buffer, value int64) {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(encoded[:], value)
+	buf.Write(encoded[:n])
+}
+
+// kafkaReader decodes a Kafka protocol response, keeping the first error
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *kafkaReader) next(n int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if n < 0 || len(reader.data) < n {
+		reader.err = errors.New("kafka response is truncated")
+		return nil
+	}
+	value := reader.data[:n]
+	reader.data = reader.data[n:]
+	return value
+}
+
+func (reader *kafkaReader) int8() int8 {
+	value := reader.next(1)
+	if value == nil {
+		return 0
+	}
+	return int8(value[0])
+}
+
+func (reader *kafkaReader) int16() int16 {
+	value := reader.next(2)
+	if value == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(value))
+}
+
+func (reader *kafkaReader) int32() int32 {
+	value := reader.next(4)
+	if value == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(value))
+}
+
+func (reader *kafkaReader) int64() int64 {
+	value := reader.next(8)
+	if value == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+// string reads a string, a null string being read as empty
+func (reader *kafkaReader) string() string {
+	length := reader.int16()
+	if length < 0 {
+		return ""
+	}
+	return string(reader.next(int(length)))
+}
+
+func (reader *kafkaReader) int32Array() {
+	for i := reader.int32(); i > 0 && reader.err == nil; i-- {
+		reader.int32()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestMurmur2(t *testing.T) {
+	// Reference values of the murmur2 hash of the Kafka clients, as signed Java integers
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, expected := range cases {
+		if hash := int32(murmur2([]byte(key))); hash != expected {
+			t.Errorf("murmur2(%q) = %d, expected %d", key, hash, expected)
+		}
+	}
+}
+
+func TestKafkaPartition(t *testing.T) {
+	for _, partitions := range []int{1, 3, 7, 64} {
+		for _, key := range []string{"", "cpu", "vcenter1.domain.com"} {
+			expected := int32((murmur2([]byte(key)) & 0x7fffffff) % uint32(partitions))
+			partition := kafkaPartition([]byte(key), partitions)
+			if partition != expected || partition < 0 || int(partition) >= partitions {
+				t.Errorf("kafkaPartition(%q, %d) = %d, expected %d", key, partitions, partition, expected)
+			}
+		}
+	}
+}
+
+func TestEncodeRecordBatch(t *testing.T) {
+	expected := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, // base offset
+		0, 0, 0, 58, // length
+		0xff, 0xff, 0xff, 0xff, // partition leader epoch
+		2,                      // magic
+		0x71, 0x6a, 0x61, 0x89, // CRC-32C
+		0, 0, // attributes
+		0, 0, 0, 0, // last offset delta
+		0, 0, 0, 0, 0, 0, 0x03, 0xe8, // first timestamp
+		0, 0, 0, 0, 0, 0, 0x03, 0xe8, // max timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
+		0xff, 0xff, // producer epoch
+		0xff, 0xff, 0xff, 0xff, // base sequence
+		0, 0, 0, 1, // records
+		0x10, 0, 0, 0, 2, 'k', 2, 'v', 0, // record
+	}
+	batch, rest := encodeRecordBatch([]kafkaRecord{{key: []byte("k"), value: []byte("v"), timestamp: 1000}})
+	if !bytes.Equal(batch, expected) {
+		t.Errorf("encodeRecordBatch = % x, expected % x", batch, expected)
+	}
+	if len(rest) != 0 {
+		t.Errorf("encodeRecordBatch left %d records", len(rest))
+	}
+}
+
+func TestEncodeRecordBatchSplits(t *testing.T) {
+	value := make([]byte, kafkaMaxBatchSize/3)
+	records := []kafkaRecord{{value: value}, {value: value}, {value: value}, {value: value}}
+	batch, rest := encodeRecordBatch(records)
+	if len(rest) != 2 {
+		t.Fatalf("encodeRecordBatch kept %d records, expected 2", len(records)-len(rest))
+	}
+	if count := binary.BigEndian.Uint32(batch[57:61]); count != 2 {
+		t.Errorf("record count = %d, expected 2", count)
+	}
+	if length := binary.BigEndian.Uint32(batch[8:12]); int(length) != len(batch)-12 {
+		t.Errorf("batch length = %d, expected %d", length, len(batch)-12)
+	}
+}
+
+func TestKafkaMetadata(t *testing.T) {
+	client, broker := net.Pipe()
+	defer broker.Close()
+
+	// Metadata v1 response: two brokers, a partition led by each and one without leader
+	var response bytes.Buffer
+	binary.Write(&response, binary.BigEndian, int32(2))
+	binary.Write(&response, binary.BigEndian, int32(1))
+	kafkaString(&response, "kafka1")
+	binary.Write(&response, binary.BigEndian, int32(9092))
+	binary.Write(&response, binary.BigEndian, int16(-1))
+	binary.Write(&response, binary.BigEndian, int32(2))
+	kafkaString(&response, "kafka2")
+	binary.Write(&response, binary.BigEndian, int32(9093))
+	binary.Write(&response, binary.BigEndian, int16(-1))
+	binary.Write(&response, binary.BigEndian, int32(1)) // controller
+	binary.Write(&response, binary.BigEndian, int32(1))
+	binary.Write(&response, binary.BigEndian, int16(0))
+	kafkaString(&response, "vsphere")
+	response.WriteByte(0)
+	binary.Write(&response, binary.BigEndian, int32(3))
+	for partition, leader := range []int32{1, 2, -1} {
+		binary.Write(&response, binary.BigEndian, int16(0))
+		binary.Write(&response, binary.BigEndian, int32(partition))
+		binary.Write(&response, binary.BigEndian, leader)
+		binary.Write(&response, binary.BigEndian, int32(0))
+		binary.Write(&response, binary.BigEndian, int32(0))
+	}
+
+	requests := make(chan []byte, 1)
+	go func() {
+		var size int32
+		binary.Read(broker, binary.BigEndian, &size)
+		request := make([]byte, size)
+		io.ReadFull(broker, request)
+		requests <- request
+		binary.Write(broker, binary.BigEndian, int32(4+response.Len()))
+		broker.Write(request[4:8]) // correlation id
+		broker.Write(response.Bytes())
+	}()
+
+	output := &KafkaOutput{Brokers: []string{"kafka1:9092"}, Topic: "vsphere", conns: map[string]net.Conn{"kafka1:9092": client}}
+	leaders, err := output.metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int32]string{0: "kafka1:9092", 1: "kafka2:9093", 2: ""}
+	if len(leaders) != len(expected) {
+		t.Fatalf("metadata = %v, expected %v", leaders, expected)
+	}
+	for partition, leader := range expected {
+		if leaders[partition] != leader {
+			t.Errorf("leader of partition %d = %q, expected %q", partition, leaders[partition], leader)
+		}
+	}
+
+	request := <-requests
+	if apiKey := int16(binary.BigEndian.Uint16(request)); apiKey != kafkaMetadataKey {
+		t.Errorf("api key = %d, expected %d", apiKey, kafkaMetadataKey)
+	}
+	if apiVersion := int16(binary.BigEndian.Uint16(request[2:])); apiVersion != kafkaMetadataVersion {
+		t.Errorf("api version = %d, expected %d", apiVersion, kafkaMetadataVersion)
+	}
+	if !bytes.HasSuffix(request, []byte{0, 0, 0, 1, 0, 7, 'v', 's', 'p', 'h', 'e', 'r', 'e'}) {
+		t.Errorf("metadata request does not ask for the topic: % x", request)
+	}
+}
+
+func TestKafkaResponseSizeBounds(t *testing.T) {
+	for _, size := range []int32{-1, 0, 3, kafkaMaxResponseSize + 1, 1<<31 - 1} {
+		client, broker := net.Pipe()
+		go func() {
+			var length int32
+			binary.Read(broker, binary.BigEndian, &length)
+			io.ReadFull(broker, make([]byte, length))
+			binary.Write(broker, binary.BigEndian, size)
+		}()
+
+		output := &KafkaOutput{Topic: "vsphere", conns: map[string]net.Conn{"kafka1:9092": client}}
+		_, err := output.request("kafka1:9092", kafkaMetadataKey, kafkaMetadataVersion, nil)
+		if err == nil {
+			t.Errorf("response size %d accepted", size)
+		}
+		if _, ok := output.conns["kafka1:9092"]; ok {
+			t.Errorf("connection kept after a response size of %d", size)
+		}
+		broker.Close()
+	}
+}
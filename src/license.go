@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// licenseKey identifies the licenses summed into a license point
+type licenseKey struct {
+	Edition  string
+	Name     string
+	CostUnit string
+}
+
+// licensePoints returns a license point per edition with the used and total capacity of its license keys
+func licensePoints(ctx context.Context, pc *property.Collector, ref types.ManagedObjectReference, vcTags map[string]string) ([]*influxclient.Point, error) {
+	var manager mo.LicenseManager
+	err := pc.RetrieveOne(ctx, ref, []string{"licenses"}, &manager)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[licenseKey]int64)
+	total := make(map[licenseKey]int64)
+	for _, license := range manager.Licenses {
+		key := licenseKey{Edition: license.EditionKey, Name: license.Name, CostUnit: license.CostUnit}
+		used[key] += int64(license.Used)
+		total[key] += int64(license.Total)
+	}
+
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for key := range total {
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["edition"] = key.Edition
+		tags["license"] = key.Name
+		tags["cost_unit"] = key.CostUnit
+		fields := map[string]interface{}{
+			"used":  used[key],
+			"total": total[key],
+		}
+		pt, err := influxclient.NewPoint("license", tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// isNoPermission tells if vCenter refused a call for lack of privileges
+func isNoPermission(err error) bool {
+	if !soap.IsVimFault(err) {
+		return false
+	}
+	_, ok := soap.ToVimFault(err).(*types.NoPermission)
+	return ok
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// lineProtocol serializes points for the text outputs, so every output renders the field types the same way:
+// integers with the i suffix, floats with FloatDecimals decimal places if set, strings quoted and escaped.
+type lineProtocol struct {
+	FloatDecimals *int
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// line returns the line of a point without its timestamp, or false when none of its fields can be written
+func (format lineProtocol) line(pt *influxclient.Point) (string, bool) {
+	fields, err := pt.Fields()
+	if err != nil {
+		errlog.Println(err)
+		return "", false
+	}
+	fieldKeys := []string{}
+	for key := range fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+	fieldParts := []string{}
+	for _, key := range fieldKeys {
+		value, ok := format.value(fields[key])
+		if !ok {
+			continue
+		}
+		fieldParts = append(fieldParts, keyEscaper.Replace(key)+"="+value)
+	}
+	if len(fieldParts) == 0 {
+		return "", false
+	}
+
+	tags := pt.Tags()
+	tagKeys := []string{}
+	for key := range tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	line := measurementEscaper.Replace(pt.Name())
+	for _, key := range tagKeys {
+		// Empty tag values are not allowed by the line protocol
+		if tags[key] == "" {
+			continue
+		}
+		line += "," + keyEscaper.Replace(key) + "=" + keyEscaper.Replace(tags[key])
+	}
+	return line + " " + strings.Join(fieldParts, ","), true
+}
+
+// value formats a field value according to its type
+func (format lineProtocol) value(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case float64:
+		return format.float(v)
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// float formats a float with the configured decimal places, or the fewest digits that represent it exactly.
+// NaN and infinite values have no representation and are left out.
+func (format lineProtocol) float(v float64) (string, bool) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "", false
+	}
+	decimals := -1
+	if format.FloatDecimals != nil {
+		decimals = *format.FloatDecimals
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64), true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+func TestLineProtocolLine(t *testing.T) {
+	two := 2
+	zero := 0
+	cases := []struct {
+		name          string
+		measurement   string
+		tags          map[string]string
+		fields        map[string]interface{}
+		floatDecimals *int
+		expected      string
+	}{
+		{"integer", "cpu", nil, map[string]interface{}{"usage": int64(42)}, nil, "cpu usage=42i"},
+		{"float shortest", "cpu", nil, map[string]interface{}{"usage": 12.5}, nil, "cpu usage=12.5"},
+		{"float decimals", "cpu", nil, map[string]interface{}{"usage": 12.3456}, &two, "cpu usage=12.35"},
+		{"float no decimals", "cpu", nil, map[string]interface{}{"usage": 12.5}, &zero, "cpu usage=12"},
+		{"integer ignores decimals", "cpu", nil, map[string]interface{}{"usage": int64(7)}, &two, "cpu usage=7i"},
+		{"bool", "host", nil, map[string]interface{}{"maintenance": true}, nil, "host maintenance=true"},
+		{"string", "host", nil, map[string]interface{}{"build": `6.7 "U3" C:\esx`}, nil, `host build="6.7 \"U3\" C:\\esx"`},
+		{"sorted fields", "mem", nil, map[string]interface{}{"b": int64(2), "a": int64(1)}, nil, "mem a=1i,b=2i"},
+		{"sorted tags", "mem", map[string]string{"vcenter": "vc1", "name": "vm1"}, map[string]interface{}{"a": int64(1)}, nil, "mem,name=vm1,vcenter=vc1 a=1i"},
+		{"empty tag left out", "mem", map[string]string{"cluster": "", "name": "vm1"}, map[string]interface{}{"a": int64(1)}, nil, "mem,name=vm1 a=1i"},
+		{"tag escaping", "mem", map[string]string{"name": "vm 1,a=b"}, map[string]interface{}{"a": int64(1)}, nil, `mem,name=vm\ 1\,a\=b a=1i`},
+		{"tag key escaping", "mem", map[string]string{"a b": "x"}, map[string]interface{}{"a": int64(1)}, nil, `mem,a\ b=x a=1i`},
+		{"field key escaping", "mem", nil, map[string]interface{}{"a,b=c d": int64(1)}, nil, `mem a\,b\=c\ d=1i`},
+		{"measurement escaping", "disk usage,total", nil, map[string]interface{}{"a": int64(1)}, nil, `disk\ usage\,total a=1i`},
+	}
+	for _, c := range cases {
+		pt, err := influxclient.NewPoint(c.measurement, c.tags, c.fields, time.Unix(0, 0))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		line, ok := lineProtocol{FloatDecimals: c.floatDecimals}.line(pt)
+		if !ok || line != c.expected {
+			t.Errorf("%s: line = %q, %v, expected %q", c.name, line, ok, c.expected)
+		}
+	}
+}
+
+func TestLineProtocolValue(t *testing.T) {
+	two := 2
+	cases := []struct {
+		value    interface{}
+		expected string
+		ok       bool
+	}{
+		{int64(-3), "-3i", true},
+		{1.0 / 3, "0.33", true},
+		{false, "false", true},
+		{"", `""`, true},
+		{[]string{"a"}, "", false},
+		{nil, "", false},
+	}
+	for _, c := range cases {
+		value, ok := lineProtocol{FloatDecimals: &two}.value(c.value)
+		if value != c.expected || ok != c.ok {
+			t.Errorf("value(%#v) = %q, %v, expected %q, %v", c.value, value, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func TestLineProtocolFloatWithoutRepresentation(t *testing.T) {
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if value, ok := (lineProtocol{}).float(v); ok {
+			t.Errorf("float(%v) = %q, expected to be left out", v, value)
+		}
+	}
+}
+
+func TestLineProtocolPointWithoutFields(t *testing.T) {
+	// A point whose fields have no line protocol representation is not written at all
+	pt, err := influxclient.NewPoint("cpu", map[string]string{"name": "vm1"}, map[string]interface{}{"usage": []byte("x")}, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, ok := (lineProtocol{}).line(pt); ok {
+		t.Errorf("line = %q, expected no line", line)
+	}
+	if b, err := (lineSerializer{}).Serialize(pt); err != nil || len(b) != 0 {
+		t.Errorf("Serialize = %q, %v, expected no bytes", b, err)
+	}
+}
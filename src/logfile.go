@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file rotated once it reaches its maximum size
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// OpenRotatingFile opens a log file for appending, rotating it past maxSize bytes and keeping maxBackups old files
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rotating := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	err := rotating.open()
+	if err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+// Write appends to the log file, rotating it first if the write would exceed the maximum size.
+// A failed rotation is reported once, the write still goes to the current log file.
+func (rotating *RotatingFile) Write(p []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	var rotateErr error
+	if rotating.MaxSize > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.MaxSize {
+		rotateErr = rotating.rotate()
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Close closes the log file
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	return rotating.file.Close()
+}
+
+// open opens the log file and records its current size
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups (path.1 is the most recent), drops the oldest and reopens an empty log file
+func (rotating *RotatingFile) rotate() error {
+	rotating.file.Close()
+	err := rotating.shift()
+	if err != nil {
+		// Keep appending to the current log file, and only retry once it grew by MaxSize again
+		openErr := rotating.open()
+		if openErr != nil {
+			return openErr
+		}
+		rotating.size = 0
+		return err
+	}
+	return rotating.open()
+}
+
+// shift renames the log file to the first backup, or removes it without backups
+func (rotating *RotatingFile) shift() error {
+	if rotating.MaxBackups <= 0 {
+		return os.Remove(rotating.Path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", rotating.Path, rotating.MaxBackups))
+	for i := rotating.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rotating.Path, i), fmt.Sprintf("%s.%d", rotating.Path, i+1))
+	}
+	return os.Rename(rotating.Path, rotating.Path+".1")
+}
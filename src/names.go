@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// objectNames returns the names of the objects, and their inventory paths when withPaths is set. With cacheCycles
+// set, they are retrieved again every cacheCycles cycles to follow renamed entities, or earlier when an object is
+// not known yet.
+func (vcenter *VCenter) objectNames(ctx context.Context, client *govmomi.Client, mors []types.ManagedObjectReference, cacheCycles int, withPaths bool) (map[types.ManagedObjectReference]string, map[types.ManagedObjectReference]string, error) {
+	if cacheCycles > 0 && vcenter.names != nil && vcenter.cycle-vcenter.namesCycle < cacheCycles && (!withPaths || vcenter.paths != nil) {
+		cached := true
+		for _, mor := range mors {
+			if _, ok := vcenter.names[mor]; !ok {
+				cached = false
+				break
+			}
+		}
+		if cached {
+			return vcenter.names, vcenter.paths, nil
+		}
+	}
+
+	pathSet := []string{"name"}
+	if withPaths {
+		pathSet = append(pathSet, "parent")
+	}
+	objects, err := retrieveEntities(ctx, client, mors, pathSet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//create a map to resolve object names
+	morToName := make(map[types.ManagedObjectReference]string)
+	for _, object := range objects {
+		morToName[object.Self] = object.Name
+	}
+	var morToPath map[types.ManagedObjectReference]string
+	if withPaths {
+		morToPath, err = inventoryPaths(ctx, client, objects)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cacheCycles > 0 {
+		vcenter.names = morToName
+		vcenter.paths = morToPath
+		vcenter.namesCycle = vcenter.cycle
+	}
+	return morToName, morToPath, nil
+}
+
+// retrieveEntities retrieves properties common to all managed entities in a single call
+func retrieveEntities(ctx context.Context, client *govmomi.Client, mors []types.ManagedObjectReference, pathSet []string) ([]mo.ManagedEntity, error) {
+	//object for propery collection
+	propSpec := &types.PropertySpec{Type: "ManagedEntity", PathSet: pathSet}
+	var objectSet []types.ObjectSpec
+	for _, mor := range mors {
+		objectSet = append(objectSet, types.ObjectSpec{Obj: mor, Skip: types.NewBool(false)})
+	}
+
+	//retrieve properties
+	propreq := types.RetrieveProperties{SpecSet: []types.PropertyFilterSpec{{ObjectSet: objectSet, PropSet: []types.PropertySpec{*propSpec}}}}
+	propres, err := client.PropertyCollector().RetrieveProperties(ctx, propreq)
+	if err != nil {
+		return nil, err
+	}
+
+	//load retrieved properties
+	objects := []mo.ManagedEntity{}
+	err = mo.LoadRetrievePropertiesResponse(propres, &objects)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// inventoryPaths returns the inventory path of the objects, such as /datacenter/vm/folder/name, by retrieving
+// their ancestors one level at a time up to the root folder, which is left out of the paths
+func inventoryPaths(ctx context.Context, client *govmomi.Client, objects []mo.ManagedEntity) (map[types.ManagedObjectReference]string, error) {
+	entities := make(map[types.ManagedObjectReference]mo.ManagedEntity)
+	for _, object := range objects {
+		entities[object.Self] = object
+	}
+	level := objects
+	for len(level) > 0 {
+		parents := []types.ManagedObjectReference{}
+		for _, object := range level {
+			if object.Parent == nil {
+				continue
+			}
+			if _, ok := entities[*object.Parent]; !ok {
+				entities[*object.Parent] = mo.ManagedEntity{}
+				parents = append(parents, *object.Parent)
+			}
+		}
+		if len(parents) == 0 {
+			break
+		}
+		var err error
+		level, err = retrieveEntities(ctx, client, parents, []string{"name", "parent"})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range level {
+			entities[object.Self] = object
+		}
+	}
+
+	paths := make(map[types.ManagedObjectReference]string)
+	for _, object := range objects {
+		path := ""
+		for entity := object; entity.Parent != nil; entity = entities[*entity.Parent] {
+			path = "/" + entity.Name + path
+		}
+		paths[object.Self] = path
+	}
+	return paths, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// portgroupPoints returns a dvs_portgroup point per distributed portgroup with its port usage
+func portgroupPoints(ctx context.Context, client *govmomi.Client, pc *property.Collector, portgroupRefs []types.ManagedObjectReference, vcTags map[string]string) ([]*influxclient.Point, error) {
+	var pgmo []mo.DistributedVirtualPortgroup
+	err := pc.Retrieve(ctx, portgroupRefs, []string{"name", "config"}, &pgmo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the portgroups by switch to fetch their connected ports once per switch
+	switchPortgroups := make(map[types.ManagedObjectReference][]string)
+	for _, pg := range pgmo {
+		if pg.Config.DistributedVirtualSwitch != nil {
+			dvs := *pg.Config.DistributedVirtualSwitch
+			switchPortgroups[dvs] = append(switchPortgroups[dvs], pg.Config.Key)
+		}
+	}
+
+	switchNames := make(map[types.ManagedObjectReference]string)
+	portsInUse := make(map[string]int64)
+	for dvs, keys := range switchPortgroups {
+		var switchmo mo.DistributedVirtualSwitch
+		err = pc.RetrieveOne(ctx, dvs, []string{"name"}, &switchmo)
+		if err != nil {
+			return nil, err
+		}
+		switchNames[dvs] = switchmo.Name
+
+		req := types.FetchDVPorts{This: dvs, Criteria: &types.DistributedVirtualSwitchPortCriteria{Connected: types.NewBool(true), PortgroupKey: keys}}
+		res, err := methods.FetchDVPorts(ctx, client.RoundTripper, &req)
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range res.Returnval {
+			portsInUse[port.PortgroupKey]++
+		}
+	}
+
+	points := []*influxclient.Point{}
+	for _, pg := range pgmo {
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["portgroup"] = pg.Name
+		tags["uplink"] = "false"
+		if boolValue(pg.Config.Uplink) {
+			tags["uplink"] = "true"
+		}
+		if pg.Config.DistributedVirtualSwitch != nil {
+			tags["dvs"] = switchNames[*pg.Config.DistributedVirtualSwitch]
+		}
+		fields := map[string]interface{}{
+			"num_ports":    int64(pg.Config.NumPorts),
+			"ports_in_use": portsInUse[pg.Config.Key],
+			"ports_free":   int64(pg.Config.NumPorts) - portsInUse[pg.Config.Key],
+		}
+		pt, err := influxclient.NewPoint("dvs_portgroup", tags, fields, time.Now())
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
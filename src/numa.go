@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// numaPoints returns a host_numa point per NUMA node of the hosts with its memory and CPU count
+func numaPoints(hsmo []mo.HostSystem, config Configuration, vcTags map[string]string) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, host := range hsmo {
+		if host.Hardware == nil || host.Hardware.NumaInfo == nil {
+			continue
+		}
+		for _, node := range host.Hardware.NumaInfo.NumaNode {
+			tags := make(map[string]string)
+			for k, v := range vcTags {
+				tags[k] = v
+			}
+			tags["name"] = strings.ToLower(config.stripName(host.Summary.Config.Name))
+			tags["node"] = strconv.Itoa(int(node.TypeId))
+			fields := map[string]interface{}{
+				"memory_size": node.MemoryRangeLength,
+				"cpu_count":   int64(len(node.CpuID)),
+			}
+			pt, err := influxclient.NewPoint("host_numa", tags, fields, now)
+			if err != nil {
+				errlog.Println(err)
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+	return points
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// Output is a destination for the collected points
+type Output interface {
+	Write(bp influxclient.BatchPoints) error
+	Close() error
+}
+
+// OutputConfig describes an output destination
+type OutputConfig struct {
+	Type       string
+	Hostname   string
+	Port       int
+	URL        string
+	Username   string
+	Password   string
+	Prefix     string
+	TagOrder   []string
+	Tagged     bool
+	Path       string
+	MaxSize    int
+	MaxBackups int
+	Precision  string
+	Brokers    []string
+	Topic      string
+	Key        string
+	Format     string
+
+	FloatDecimals *int
+}
+
+// InfluxDBOutput writes points to InfluxDB in line protocol over its own HTTP client, which honours the proxy
+type InfluxDBOutput struct {
+	PingURL  string
+	WriteURL string
+	Username string
+	Password string
+
+	httpClient *http.Client
+}
+
+// NewInfluxDBOutput creates the InfluxDB output, writing to the configured write endpoint if any
+func NewInfluxDBOutput(config InfluxDB) (*InfluxDBOutput, error) {
+	base, err := url.Parse(config.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	pingURL := *base
+	pingURL.Path = path.Join(base.Path, "ping")
+
+	// The write path is either a full URL or a path on the InfluxDB host, /write by default
+	writeURL := *base
+	writeURL.Path = path.Join(base.Path, "write")
+	if config.WritePath != "" {
+		u, err := url.Parse(config.WritePath)
+		if err != nil {
+			return nil, err
+		}
+		if u.IsAbs() {
+			writeURL = *u
+		} else {
+			writeURL.Path = config.WritePath
+		}
+	}
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := config.ProxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	return &InfluxDBOutput{
+		PingURL:    pingURL.String(),
+		WriteURL:   writeURL.String(),
+		Username:   config.Username,
+		Password:   config.Password,
+		httpClient: &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: proxy}},
+	}, nil
+}
+
+// Ping checks InfluxDB answers within the timeout, returning its version
+func (output *InfluxDBOutput) Ping(timeout time.Duration) (string, error) {
+	req, err := http.NewRequest("GET", output.PingURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if output.Username != "" {
+		req.SetBasicAuth(output.Username, output.Password)
+	}
+	client := *output.httpClient
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("ping of %s failed with %s: %s", output.PingURL, resp.Status, body)
+	}
+	return resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// Write sends the points to InfluxDB
+func (output *InfluxDBOutput) Write(bp influxclient.BatchPoints) error {
+	return output.writeLines(bp)
+}
+
+// writeLines sends the points in line protocol to the configured write endpoint
+func (output *InfluxDBOutput) writeLines(bp influxclient.BatchPoints) error {
+	var lines bytes.Buffer
+	for _, pt := range bp.Points() {
+		lines.WriteString(pt.PrecisionString(bp.Precision()))
+		lines.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest("POST", output.WriteURL, &lines)
+	if err != nil {
+		return err
+	}
+	if output.Username != "" {
+		req.SetBasicAuth(output.Username, output.Password)
+	}
+	params := req.URL.Query()
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := output.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("write to %s failed with %s: %s", output.WriteURL, resp.Status, body)
+	}
+	return nil
+}
+
+// Close does nothing as the HTTP client keeps no state to release
+func (output *InfluxDBOutput) Close() error {
+	return nil
+}
+
+// MultiOutput writes points to every configured output
+type MultiOutput []Output
+
+// Write sends the points to every output, returning the last error encountered
+func (outputs MultiOutput) Write(bp influxclient.BatchPoints) error {
+	var lastErr error
+	for _, output := range outputs {
+		err := output.Write(bp)
+		if err != nil {
+			errlog.Println("Could not write to output: ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Close closes every output, returning the last error encountered
+func (outputs MultiOutput) Close() error {
+	var lastErr error
+	for _, output := range outputs {
+		err := output.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// UsesInfluxDB tells if points are written to InfluxDB
+func (config Configuration) UsesInfluxDB() bool {
+	if len(config.Outputs) == 0 {
+		return true
+	}
+	for _, outputConfig := range config.Outputs {
+		if outputConfig.Type == "influxdb" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewOutputs creates the configured outputs, defaulting to InfluxDB when none are configured
+func NewOutputs(config Configuration, influxDBOutput *InfluxDBOutput) (MultiOutput, error) {
+	var influxOutput Output = influxDBOutput
+	var err error
+	if config.InfluxDB.ChunkSize > 0 {
+		influxOutput = NewChunkedOutput(influxOutput, config.InfluxDB.ChunkSize, config.InfluxDB.ChunkRetries)
+	}
+	if len(config.Outputs) == 0 {
+		return MultiOutput{influxOutput}, nil
+	}
+
+	outputs := MultiOutput{}
+	for _, outputConfig := range config.Outputs {
+		switch outputConfig.Type {
+		case "influxdb":
+			_, err = outputFormat(outputConfig)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, influxOutput)
+		case "graphite":
+			graphiteOutput, err := NewGraphiteOutput(outputConfig)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, graphiteOutput)
+		case "prometheus":
+			_, err = outputFormat(outputConfig)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, NewPrometheusOutput(outputConfig))
+		case "influxdb-udp":
+			udpOutput, err := NewUDPOutput(outputConfig)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, udpOutput)
+		case "kafka":
+			kafkaOutput, err := NewKafkaOutput(outputConfig)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, kafkaOutput)
+		case "file":
+			fileOutput, err := NewFileOutput(outputConfig)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, fileOutput)
+		default:
+			return nil, fmt.Errorf("unknown output type: %q", outputConfig.Type)
+		}
+	}
+	return outputs, nil
+}
+
+// LimitedOutput bounds the number of concurrent writes to an output
+type LimitedOutput struct {
+	output    Output
+	semaphore chan struct{}
+}
+
+// NewLimitedOutput wraps an output so at most maxConcurrentWrites writes are in flight
+func NewLimitedOutput(output Output, maxConcurrentWrites int) *LimitedOutput {
+	return &LimitedOutput{output: output, semaphore: make(chan struct{}, maxConcurrentWrites)}
+}
+
+// Write sends the points once a write slot is available
+func (limited *LimitedOutput) Write(bp influxclient.BatchPoints) error {
+	select {
+	case limited.semaphore <- struct{}{}:
+	default:
+		stdlog.Println("Write of ", len(bp.Points()), " points queued, ", cap(limited.semaphore), " writes already in flight")
+		limited.semaphore <- struct{}{}
+	}
+	defer func() { <-limited.semaphore }()
+	return limited.output.Write(bp)
+}
+
+// Close closes the wrapped output
+func (limited *LimitedOutput) Close() error {
+	return limited.output.Close()
+}
+
+// ChunkedOutput splits large batches into requests of a bounded number of points
+type ChunkedOutput struct {
+	output    Output
+	chunkSize int
+	retries   int
+}
+
+// NewChunkedOutput wraps an output so batches are written in chunks of at most chunkSize points,
+// each retried up to retries times on failure
+func NewChunkedOutput(output Output, chunkSize int, retries int) *ChunkedOutput {
+	return &ChunkedOutput{output: output, chunkSize: chunkSize, retries: retries}
+}
+
+// Write sends the chunks one after the other, so a failed chunk does not prevent the others from being written.
+// It returns the error of the last chunk that could not be written.
+func (chunked *ChunkedOutput) Write(bp influxclient.BatchPoints) error {
+	points := bp.Points()
+	if len(points) <= chunked.chunkSize {
+		return chunked.output.Write(bp)
+	}
+
+	var lastErr error
+	chunks, failed := 0, 0
+	for start := 0; start < len(points); start += chunked.chunkSize {
+		end := start + chunked.chunkSize
+		if end > len(points) {
+			end = len(points)
+		}
+		chunk, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
+			Database:         bp.Database(),
+			RetentionPolicy:  bp.RetentionPolicy(),
+			Precision:        bp.Precision(),
+			WriteConsistency: bp.WriteConsistency(),
+		})
+		if err != nil {
+			return err
+		}
+		chunk.AddPoints(points[start:end])
+		chunks++
+
+		err = chunked.output.Write(chunk)
+		for retry := 0; err != nil && retry < chunked.retries; retry++ {
+			errlog.Println("Could not write chunk ", chunks, " of ", end-start, " points, retrying: ", err)
+			time.Sleep(time.Second)
+			err = chunked.output.Write(chunk)
+		}
+		if err != nil {
+			errlog.Println("Could not write chunk ", chunks, " of ", end-start, " points: ", err)
+			failed++
+			lastErr = err
+		}
+	}
+	stdlog.Println("Wrote ", chunks-failed, " of ", chunks, " chunks of ", len(points), " points to database ", bp.Database())
+	return lastErr
+}
+
+// Close closes the wrapped output
+func (chunked *ChunkedOutput) Close() error {
+	return chunked.output.Close()
+}
+
+// batchKey identifies the batch settings points were written with
+type batchKey struct {
+	Database        string
+	RetentionPolicy string
+	Precision       string
+}
+
+// bufferedPoint is a point waiting in the buffer with the batch settings it was written with
+type bufferedPoint struct {
+	key   batchKey
+	point *influxclient.Point
+}
+
+// droppedPoints counts the points dropped by the buffered outputs because their buffer was full
+var droppedPoints int64
+
+// BufferedOutput accumulates points and writes them on a timer or once enough points are buffered.
+// With a maximum size, the points of failed flushes are kept to be written by the next flush, and the buffer
+// drops its oldest or its newest points when full rather than growing during an outage.
+type BufferedOutput struct {
+	output       Output
+	flushSize    int
+	maxSize      int
+	dropNewest   bool
+	drainTimeout time.Duration
+	mutex        sync.Mutex
+	points       []bufferedPoint
+	closed       bool
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewBufferedOutput wraps an output and starts flushing it every interval, if any.
+// On close, the remaining points are flushed for at most drainTimeout.
+func NewBufferedOutput(output Output, flushInterval time.Duration, flushSize int, maxSize int, dropPolicy string, drainTimeout time.Duration) *BufferedOutput {
+	buffered := &BufferedOutput{
+		output:       output,
+		flushSize:    flushSize,
+		maxSize:      maxSize,
+		dropNewest:   dropPolicy == "newest",
+		drainTimeout: drainTimeout,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go buffered.run(flushInterval)
+	return buffered
+}
+
+// Write adds the points to the buffer, flushing it when it is full
+func (buffered *BufferedOutput) Write(bp influxclient.BatchPoints) error {
+	key := batchKey{Database: bp.Database(), RetentionPolicy: bp.RetentionPolicy(), Precision: bp.Precision()}
+	buffered.mutex.Lock()
+	if buffered.closed {
+		buffered.mutex.Unlock()
+		return errors.New("buffered output is closed")
+	}
+	for _, pt := range bp.Points() {
+		buffered.points = append(buffered.points, bufferedPoint{key: key, point: pt})
+	}
+	buffered.limit(false)
+	full := buffered.flushSize > 0 && len(buffered.points) >= buffered.flushSize
+	buffered.mutex.Unlock()
+
+	if full {
+		return buffered.Flush()
+	}
+	return nil
+}
+
+// limit drops points beyond the maximum size, the newest ones or the oldest ones. Requeued points are older than
+// the buffered ones. It must be called with the mutex held.
+func (buffered *BufferedOutput) limit(requeued bool) {
+	excess := len(buffered.points) - buffered.maxSize
+	if buffered.maxSize <= 0 || excess <= 0 {
+		return
+	}
+	if buffered.dropNewest && !requeued {
+		buffered.points = buffered.points[:buffered.maxSize]
+	} else {
+		buffered.points = append([]bufferedPoint{}, buffered.points[excess:]...)
+	}
+	atomic.AddInt64(&droppedPoints, int64(excess))
+	errlog.Println("Output buffer full, dropped ", excess, " points")
+}
+
+// Flush writes every buffered point to the wrapped output
+func (buffered *BufferedOutput) Flush() error {
+	buffered.mutex.Lock()
+	points := buffered.points
+	buffered.points = nil
+	buffered.mutex.Unlock()
+
+	batches := make(map[batchKey][]*influxclient.Point)
+	keys := []batchKey{}
+	for _, entry := range points {
+		if _, ok := batches[entry.key]; !ok {
+			keys = append(keys, entry.key)
+		}
+		batches[entry.key] = append(batches[entry.key], entry.point)
+	}
+
+	var lastErr error
+	failed := []bufferedPoint{}
+	for _, key := range keys {
+		bp, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
+			Database:        key.Database,
+			RetentionPolicy: key.RetentionPolicy,
+			Precision:       key.Precision,
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		bp.AddPoints(batches[key])
+		err = buffered.output.Write(bp)
+		if err != nil {
+			lastErr = err
+			for _, pt := range batches[key] {
+				failed = append(failed, bufferedPoint{key: key, point: pt})
+			}
+		}
+	}
+
+	// Keep the points that could not be written for the next flush, ahead of the newer ones
+	if len(failed) > 0 && buffered.maxSize > 0 {
+		buffered.mutex.Lock()
+		if !buffered.closed {
+			buffered.points = append(failed, buffered.points...)
+			buffered.limit(true)
+		}
+		buffered.mutex.Unlock()
+	}
+	return lastErr
+}
+
+// Close stops accepting points, drains the buffer and closes the wrapped output
+func (buffered *BufferedOutput) Close() error {
+	buffered.mutex.Lock()
+	buffered.closed = true
+	buffered.mutex.Unlock()
+
+	close(buffered.stop)
+	<-buffered.done
+	drainErr := buffered.Drain(buffered.drainTimeout)
+	err := buffered.output.Close()
+	if drainErr != nil {
+		return drainErr
+	}
+	return err
+}
+
+// Drain flushes the remaining points, giving up after timeout, and logs how many were flushed or dropped.
+// It returns an error when points were dropped.
+func (buffered *BufferedOutput) Drain(timeout time.Duration) error {
+	buffered.mutex.Lock()
+	pending := len(buffered.points)
+	buffered.mutex.Unlock()
+	if pending == 0 {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- buffered.Flush()
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			errlog.Println("Could not flush buffered points on shutdown: ", err)
+			errlog.Println("Dropped ", pending, " buffered points")
+			return err
+		}
+		stdlog.Println("Flushed ", pending, " buffered points on shutdown")
+		return nil
+	case <-time.After(timeout):
+		errlog.Println("Timed out flushing buffered points on shutdown, dropped ", pending, " points")
+		return fmt.Errorf("timed out flushing %d buffered points", pending)
+	}
+}
+
+// run flushes the buffer every interval until the output is closed
+func (buffered *BufferedOutput) run(flushInterval time.Duration) {
+	defer close(buffered.done)
+	if flushInterval <= 0 {
+		<-buffered.stop
+		return
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-buffered.stop:
+			return
+		case <-ticker.C:
+			err := buffered.Flush()
+			if err != nil {
+				errlog.Println("Could not flush buffered points: ", err)
+			}
+		}
+	}
+}
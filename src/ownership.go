@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// Ownership writes an ownership point per VM and host, tagged with the custom attributes and the vSphere tag
+// categories naming their owner, so the perf points do not have to carry these tags
+type Ownership struct {
+	Attributes []string
+	Categories []string
+}
+
+// enabled tells if an ownership attribute or category is configured
+func (ownership Ownership) enabled() bool {
+	return len(ownership.Attributes) > 0 || len(ownership.Categories) > 0
+}
+
+// ownershipKey returns the tag key of an attribute or category name, e.g. cost_center for "Cost Center"
+func ownershipKey(name string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(name), " ", "_", -1))
+}
+
+// ownershipPoints returns an ownership point per entity, tagged with its name, its type and its owners, with a
+// count of 1 to sum the entities per owner
+func (vcenter *VCenter) ownershipPoints(ctx context.Context, pc *property.Collector, customFieldsManager *types.ManagedObjectReference, refsByType [][]types.ManagedObjectReference, names map[types.ManagedObjectReference]string, config Configuration, vcTags map[string]string) ([]*influxclient.Point, error) {
+	owners := make(map[types.ManagedObjectReference]map[string]string)
+	owner := func(ref types.ManagedObjectReference, key string, value string) {
+		if owners[ref] == nil {
+			owners[ref] = make(map[string]string)
+		}
+		owners[ref][key] = value
+	}
+
+	// Custom attributes are values of the entities, keyed by the definitions of the custom fields manager
+	if len(config.Ownership.Attributes) > 0 && customFieldsManager != nil {
+		var manager mo.CustomFieldsManager
+		err := pc.RetrieveOne(ctx, *customFieldsManager, []string{"field"}, &manager)
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[int32]string)
+		for _, field := range manager.Field {
+			for _, attribute := range config.Ownership.Attributes {
+				if field.Name == attribute {
+					fields[field.Key] = ownershipKey(attribute)
+				}
+			}
+		}
+		for _, refs := range refsByType {
+			if len(refs) == 0 || len(fields) == 0 {
+				continue
+			}
+			var entities []mo.ManagedEntity
+			err = pc.Retrieve(ctx, refs, []string{"customValue"}, &entities)
+			if err != nil {
+				return nil, err
+			}
+			for _, entity := range entities {
+				for _, base := range entity.CustomValue {
+					value, ok := base.(*types.CustomFieldStringValue)
+					if ok && fields[value.Key] != "" && value.Value != "" {
+						owner(entity.Self, fields[value.Key], value.Value)
+					}
+				}
+			}
+		}
+	}
+
+	// vSphere tags are only available through the REST API
+	if len(config.Ownership.Categories) > 0 {
+		rest, err := NewRestClient(vcenter)
+		if err != nil {
+			return nil, err
+		}
+		defer rest.Logout()
+		tags, err := rest.CategoryTags(config.Ownership.Categories)
+		if err != nil {
+			return nil, err
+		}
+		for ref, categories := range tags {
+			for category, tag := range categories {
+				owner(ref, ownershipKey(category), tag)
+			}
+		}
+	}
+
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, refs := range refsByType {
+		for _, ref := range refs {
+			tags := make(map[string]string)
+			for k, v := range vcTags {
+				tags[k] = v
+			}
+			for k, v := range owners[ref] {
+				tags[k] = v
+			}
+			tags["name"] = strings.ToLower(config.stripName(names[ref]))
+			tags["type"] = strings.ToLower(ref.Type)
+			pt, err := influxclient.NewPoint("ownership", tags, map[string]interface{}{"count": int64(1)}, now)
+			if err != nil {
+				errlog.Println(err)
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+	return points, nil
+}
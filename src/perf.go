@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// queryPerf queries the performances of the entities. When retryDelay is set and no entity returned a sample
+// although some did in the previous cycle, the empty result is taken for a stats hiccup and the query is retried once.
+func (vcenter *VCenter) queryPerf(ctx context.Context, client *govmomi.Client, queries []types.PerfQuerySpec, retryDelay time.Duration) ([]types.BasePerfEntityMetricBase, error) {
+	results, err := vcenter.queryPerfChunks(ctx, client, queries)
+	if err != nil {
+		return nil, err
+	}
+	if retryDelay > 0 && !hasSamples(results) && vcenter.hadSamples(queries) {
+		stdlog.Println("vcenter ", vcenter.Hostname, " returned no performance samples, retrying in ", retryDelay)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return results, nil
+		}
+		results, err = vcenter.queryPerfChunks(ctx, client, queries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Remember the entities with samples, entities created since then legitimately have none
+	if hasSamples(results) {
+		vcenter.sampledEntities = make(map[types.ManagedObjectReference]bool)
+		for _, base := range results {
+			if em, ok := base.(*types.PerfEntityMetric); ok && len(em.Value) > 0 {
+				vcenter.sampledEntities[em.Entity] = true
+			}
+		}
+	}
+	return results, nil
+}
+
+// hasSamples tells whether any entity returned samples
+func hasSamples(results []types.BasePerfEntityMetricBase) bool {
+	for _, base := range results {
+		if em, ok := base.(*types.PerfEntityMetric); ok && len(em.Value) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hadSamples tells whether any of the queried entities returned samples in the previous cycle
+func (vcenter *VCenter) hadSamples(queries []types.PerfQuerySpec) bool {
+	for _, query := range queries {
+		if vcenter.sampledEntities[query.Entity] {
+			return true
+		}
+	}
+	return false
+}
+
+// queryPerfChunks queries the performances of the entities, in chunks no larger than the last query vCenter accepted.
+// After a cycle without split, the chunks are doubled until the queries are no longer split.
+func (vcenter *VCenter) queryPerfChunks(ctx context.Context, client *govmomi.Client, queries []types.PerfQuerySpec) ([]types.BasePerfEntityMetricBase, error) {
+	chunkSize := len(queries)
+	if vcenter.perfChunkSize > 0 && vcenter.perfChunkSize < chunkSize {
+		chunkSize = vcenter.perfChunkSize
+	}
+
+	results := []types.BasePerfEntityMetricBase{}
+	split := false
+	for start := 0; start < len(queries); start += chunkSize {
+		end := start + chunkSize
+		if end > len(queries) {
+			end = len(queries)
+		}
+		chunk, chunkSplit, err := vcenter.queryPerfChunk(ctx, client, queries[start:end])
+		if err != nil {
+			return nil, err
+		}
+		split = split || chunkSplit
+		results = append(results, chunk...)
+	}
+
+	if !split && vcenter.perfChunkSize > 0 {
+		vcenter.perfChunkSize *= 2
+		if vcenter.perfChunkSize >= len(queries) {
+			vcenter.perfChunkSize = 0
+			stdlog.Println("vcenter ", vcenter.Hostname, " accepted the performance queries, no longer splitting them")
+		} else {
+			stdlog.Println("vcenter ", vcenter.Hostname, " accepted the performance queries, querying ", vcenter.perfChunkSize, " entities at a time")
+		}
+	}
+	return results, nil
+}
+
+// queryPerfChunk queries the performances of a chunk of entities. vCenter faults on queries exceeding its
+// limits, so a query faulting on its size is split in halves until they are accepted, and later cycles use
+// that size. Other faults fail the query. It tells whether the query was split.
+func (vcenter *VCenter) queryPerfChunk(ctx context.Context, client *govmomi.Client, queries []types.PerfQuerySpec) ([]types.BasePerfEntityMetricBase, bool, error) {
+	req := types.QueryPerf{This: *client.ServiceContent.PerfManager, QuerySpec: queries}
+	res, err := methods.QueryPerf(ctx, client.RoundTripper, &req)
+	if err == nil {
+		return res.Returnval, false, nil
+	}
+	if !isQuerySizeFault(err) || len(queries) <= 1 {
+		return nil, false, err
+	}
+
+	half := len(queries) / 2
+	stdlog.Println("vcenter ", vcenter.Hostname, " faulted on the size of a performance query of ", len(queries), " entities, splitting it in queries of ", half, " entities. Error: ", err)
+	if vcenter.perfChunkSize == 0 || half < vcenter.perfChunkSize {
+		vcenter.perfChunkSize = half
+	}
+	first, _, err := vcenter.queryPerfChunk(ctx, client, queries[:half])
+	if err != nil {
+		return nil, true, err
+	}
+	second, _, err := vcenter.queryPerfChunk(ctx, client, queries[half:])
+	if err != nil {
+		return nil, true, err
+	}
+	return append(first, second...), true, nil
+}
+
+// isQuerySizeFault tells whether a performance query faulted on exceeding the number of metrics vCenter accepts in
+// a query, config.vpxd.stats.maxQueryMetrics, which it reports as an invalid querySpec.size argument
+func isQuerySizeFault(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	fault := soap.ToSoapFault(err)
+	if invalid, ok := fault.VimFault().(types.InvalidArgument); ok && invalid.InvalidProperty == "querySpec.size" {
+		return true
+	}
+	return strings.Contains(fault.String, "querySpec.size")
+}
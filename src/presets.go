@@ -0,0 +1,47 @@
+package main
+
+// metricPresets are built-in metric definitions that can be enabled by name with Configuration.Presets
+var metricPresets = map[string][]Metric{
+	// Memory pressure indicators, all reported as averages in KB (rates in KBps)
+	"memory": {
+		{
+			ObjectType: []string{"VirtualMachine"},
+			Definition: []MetricDef{
+				{Metric: "mem.vmmemctl.average", Instances: ""},
+				{Metric: "mem.swapped.average", Instances: ""},
+				{Metric: "mem.compressed.average", Instances: ""},
+				{Metric: "mem.swapinRate.average", Instances: ""},
+				{Metric: "mem.swapoutRate.average", Instances: ""},
+			},
+		},
+	},
+	// CPU and memory contention indicators, the CPU summations also get a percentage field
+	"contention": {
+		{
+			ObjectType: []string{"VirtualMachine", "HostSystem"},
+			Definition: []MetricDef{
+				{Metric: "cpu.ready.summation", Instances: ""},
+				{Metric: "cpu.costop.summation", Instances: ""},
+				{Metric: "mem.latency.average", Instances: ""},
+			},
+		},
+	},
+}
+
+// contentionFields are the percentage fields derived from summations of milliseconds over the sampling interval
+var contentionFields = map[string]string{
+	"cpu.ready.summation":  "cpu_ready_percent",
+	"cpu.costop.summation": "cpu_costop_percent",
+}
+
+// contentionPercent returns the share of the sampling interval a summation of milliseconds accounts for
+func contentionPercent(values []int64, intervalMs int64) float64 {
+	var total, count int64
+	for _, value := range values {
+		if value >= 0 {
+			total += value
+			count++
+		}
+	}
+	return percent(total, count*intervalMs)
+}
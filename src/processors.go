@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// PointProcessor derives metrics from the points of a vCenter collection before they are written.
+// It returns the points to write, and may add, modify or remove points. With Priorities, the points of the tiers
+// already written come first and are not written again, so they must be kept in place.
+type PointProcessor interface {
+	Process(points []*influxclient.Point) []*influxclient.Point
+}
+
+// pointProcessors are the built-in processors that can be enabled by name with Configuration.Processors.
+// They are created for each collection with the tags identifying the vCenter.
+var pointProcessors = map[string]func(config Configuration, vcTags map[string]string) PointProcessor{
+	// Totals and averages of the host metrics per cluster
+	"cluster_aggregates": func(config Configuration, vcTags map[string]string) PointProcessor {
+		return &aggregateProcessor{
+			Source:      config.measurementName("HostSystem", "hostsystem"),
+			GroupBy:     "cluster",
+			Measurement: "cluster_hosts",
+			Tags:        vcTags,
+		}
+	},
+	// Totals and averages of the VM metrics per host
+	"host_aggregates": func(config Configuration, vcTags map[string]string) PointProcessor {
+		return &aggregateProcessor{
+			Source:      config.measurementName("VirtualMachine", "virtualmachine"),
+			GroupBy:     config.esxTagKey(),
+			Measurement: "host_vms",
+			Tags:        vcTags,
+		}
+	},
+}
+
+// newPointProcessors creates the processors enabled in the configuration, in order
+func newPointProcessors(config Configuration, vcTags map[string]string) []PointProcessor {
+	processors := []PointProcessor{}
+	for _, name := range config.Processors {
+		if create, ok := pointProcessors[name]; ok {
+			processors = append(processors, create(config, vcTags))
+		}
+	}
+	return processors
+}
+
+// aggregateProcessor adds a point per value of the GroupBy tag of the Source points, with the count of points
+// and the sum and average of each numeric field. The points without the tag are not aggregated.
+type aggregateProcessor struct {
+	Source      string
+	GroupBy     string
+	Measurement string
+	Tags        map[string]string
+}
+
+// aggregate accumulates the fields of the points of a group
+type aggregate struct {
+	count  int64
+	sums   map[string]float64
+	counts map[string]int64
+	time   time.Time
+}
+
+// Process appends the aggregated points to the points
+func (processor *aggregateProcessor) Process(points []*influxclient.Point) []*influxclient.Point {
+	groups := make(map[string]*aggregate)
+	for _, pt := range points {
+		group := pt.Tags()[processor.GroupBy]
+		if pt.Name() != processor.Source || group == "" {
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			continue
+		}
+		agg, ok := groups[group]
+		if !ok {
+			agg = &aggregate{sums: make(map[string]float64), counts: make(map[string]int64)}
+			groups[group] = agg
+		}
+		agg.count++
+		if pt.Time().After(agg.time) {
+			agg.time = pt.Time()
+		}
+		for field, value := range fields {
+			if number, ok := prometheusValue(value); ok {
+				agg.sums[field] += number
+				agg.counts[field]++
+			}
+		}
+	}
+
+	names := []string{}
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		agg := groups[group]
+		fields := map[string]interface{}{"count": agg.count}
+		for field, sum := range agg.sums {
+			fields[field+"_sum"] = sum
+			fields[field+"_avg"] = sum / float64(agg.counts[field])
+		}
+		tags := map[string]string{processor.GroupBy: group}
+		for key, value := range processor.Tags {
+			tags[key] = value
+		}
+		pt, err := influxclient.NewPoint(processor.Measurement, tags, fields, agg.time)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
+
+// processorNames lists the built-in processors for the error messages
+func processorNames() string {
+	names := []string{}
+	for name := range pointProcessors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
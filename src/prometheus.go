@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// invalidPrometheusChars matches the characters not allowed in Prometheus metric and label names
+var invalidPrometheusChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// PrometheusOutput sends points to a Prometheus remote-write endpoint
+type PrometheusOutput struct {
+	URL      string
+	Username string
+	Password string
+	client   *http.Client
+}
+
+// prometheusLabel is a remote-write label
+type prometheusLabel struct {
+	Name  string
+	Value string
+}
+
+// NewPrometheusOutput creates a Prometheus remote-write output from its configuration
+func NewPrometheusOutput(config OutputConfig) *PrometheusOutput {
+	return &PrometheusOutput{
+		URL:      config.URL,
+		Username: config.Username,
+		Password: config.Password,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Write sends the points as one snappy compressed remote-write request, one series per numeric field
+func (output *PrometheusOutput) Write(bp influxclient.BatchPoints) error {
+	var request bytes.Buffer
+	for _, pt := range bp.Points() {
+		fields, err := pt.Fields()
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		for field, value := range fields {
+			number, ok := prometheusValue(value)
+			if !ok {
+				continue
+			}
+			labels := []prometheusLabel{{Name: "__name__", Value: prometheusName(pt.Name() + "_" + field)}}
+			for key, tag := range pt.Tags() {
+				labels = append(labels, prometheusLabel{Name: prometheusName(key), Value: tag})
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+			protoBytes(&request, 1, encodeTimeSeries(labels, number, pt.Time().UnixNano()/int64(time.Millisecond)))
+		}
+	}
+
+	req, err := http.NewRequest("POST", output.URL, bytes.NewReader(snappyEncode(request.Bytes())))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if output.Username != "" {
+		req.SetBasicAuth(output.Username, output.Password)
+	}
+
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("remote write to %s failed with %s: %s", output.URL, resp.Status, body)
+	}
+	return nil
+}
+
+// Close does nothing as requests do not keep state
+func (output *PrometheusOutput) Close() error {
+	return nil
+}
+
+// prometheusName turns a measurement, field or tag name into a valid Prometheus name
+func prometheusName(name string) string {
+	return invalidPrometheusChars.ReplaceAllString(name, "_")
+}
+
+// prometheusValue converts a field value to a sample value, Prometheus only supports numbers
+func prometheusValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// encodeTimeSeries encodes a remote-write TimeSeries message holding a single sample
+func encodeTimeSeries(labels []prometheusLabel, value float64, timestamp int64) []byte {
+	var series bytes.Buffer
+	for _, label := range labels {
+		var encoded bytes.Buffer
+		protoBytes(&encoded, 1, []byte(label.Name))
+		protoBytes(&encoded, 2, []byte(label.Value))
+		protoBytes(&series, 1, encoded.Bytes())
+	}
+
+	var sample bytes.Buffer
+	protoKey(&sample, 1, 1)
+	binary.Write(&sample, binary.LittleEndian, math.Float64bits(value))
+	protoKey(&sample, 2, 0)
+	protoVarint(&sample, uint64(timestamp))
+	protoBytes(&series, 2, sample.Bytes())
+	return series.Bytes()
+}
+
+// protoKey writes the key of a protobuf field
+func protoKey(buf *bytes.Buffer, field int, wireType int) {
+	protoVarint(buf, uint64(field<<3|wireType))
+}
+
+// protoVarint writes a protobuf varint
+func protoVarint(buf *bytes.Buffer, value uint64) {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], value)
+	buf.Write(encoded[:n])
+}
+
+// protoBytes writes a length-delimited protobuf field
+func protoBytes(buf *bytes.Buffer, field int, value []byte) {
+	protoKey(buf, field, 2)
+	protoVarint(buf, uint64(len(value)))
+	buf.Write(value)
+}
+
+// snappyEncode frames data in the snappy block format using literals only,
+// which every snappy decoder accepts without requiring a compression library
+func snappyEncode(data []byte) []byte {
+	var buf bytes.Buffer
+	protoVarint(&buf, uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			buf.WriteByte(byte(n << 2))
+		case n < 1<<8:
+			buf.WriteByte(60 << 2)
+			buf.WriteByte(byte(n))
+		default:
+			buf.WriteByte(61 << 2)
+			buf.WriteByte(byte(n))
+			buf.WriteByte(byte(n >> 8))
+		}
+		buf.Write(chunk)
+		data = data[len(chunk):]
+	}
+	return buf.Bytes()
+}
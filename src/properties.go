@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// retrieveProperties retrieves the properties of the objects into dst like property.Collector.Retrieve does, which
+// fails the whole retrieval on the first object with a faulted property, e.g. a permission denied on a single VM.
+// Unless faults is "fail", the faulted objects are logged and skipped instead, and their number is returned.
+func (vcenter *VCenter) retrieveProperties(ctx context.Context, pc *property.Collector, refs []types.ManagedObjectReference, props []string, dst interface{}, faults string) (int, error) {
+	if faults == "fail" {
+		return 0, pc.Retrieve(ctx, refs, props, dst)
+	}
+
+	var contents []types.ObjectContent
+	err := pc.Retrieve(ctx, refs, props, &contents)
+	if err != nil {
+		return 0, err
+	}
+	kept := []types.ObjectContent{}
+	faulted := 0
+	for _, content := range contents {
+		if len(content.MissingSet) > 0 {
+			missing := content.MissingSet[0]
+			errlog.Println("Warning: skipping ", content.Obj.Type, " ", content.Obj.Value, " of vcenter: ", vcenter.Hostname, ", its property ", missing.Path, " faulted: ", soap.WrapVimFault(missing.Fault.Fault))
+			faulted++
+			continue
+		}
+		kept = append(kept, content)
+	}
+	return faulted, mo.LoadRetrievePropertiesResponse(&types.RetrievePropertiesResponse{Returnval: kept}, dst)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// RestClient is a client for the vCenter REST (vAPI) endpoints, used for features the SOAP API lacks
+type RestClient struct {
+	base    string
+	client  *http.Client
+	session string
+}
+
+// NewRestClient logs in to the REST endpoints of a vCenter
+func NewRestClient(vcenter *VCenter) (*RestClient, error) {
+	rest := &RestClient{
+		base: "https://" + vcenter.Hostname + "/rest",
+		client: &http.Client{
+			Timeout:   60 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		},
+	}
+
+	req, err := http.NewRequest("POST", rest.base+"/com/vmware/cis/session", nil)
+	if err != nil {
+		return nil, err
+	}
+	username, password, err := vcenter.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(username, password)
+	err = rest.send(req, &rest.session)
+	if err != nil {
+		return nil, err
+	}
+	return rest, nil
+}
+
+// Logout ends the REST session
+func (rest *RestClient) Logout() {
+	rest.do("DELETE", "/com/vmware/cis/session", nil, nil)
+}
+
+// do sends a request to a REST endpoint and decodes the returned value into result
+func (rest *RestClient) do(method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, rest.base+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("vmware-api-session-id", rest.session)
+	return rest.send(req, result)
+}
+
+// send executes a request and unwraps the value of its response
+func (rest *RestClient) send(req *http.Request, result interface{}) error {
+	resp, err := rest.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s failed with %s: %s", req.Method, req.URL.Path, resp.Status, content)
+	}
+	if result == nil || len(content) == 0 {
+		return nil
+	}
+	response := struct {
+		Value interface{} `json:"value"`
+	}{Value: result}
+	return json.Unmarshal(content, &response)
+}
+
+// TaggedObjects returns the objects bearing the tag with the given name, in the given category if any
+func (rest *RestClient) TaggedObjects(category string, name string) (map[types.ManagedObjectReference]bool, error) {
+	var tagIDs []string
+	err := rest.do("GET", "/com/vmware/cis/tagging/tag", nil, &tagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[types.ManagedObjectReference]bool)
+	categoryNames := make(map[string]string)
+	for _, tagID := range tagIDs {
+		var tag struct {
+			Name       string `json:"name"`
+			CategoryID string `json:"category_id"`
+		}
+		err = rest.do("GET", "/com/vmware/cis/tagging/tag/id:"+tagID, nil, &tag)
+		if err != nil {
+			return nil, err
+		}
+		if tag.Name != name {
+			continue
+		}
+		if category != "" {
+			if _, ok := categoryNames[tag.CategoryID]; !ok {
+				var tagCategory struct {
+					Name string `json:"name"`
+				}
+				err = rest.do("GET", "/com/vmware/cis/tagging/category/id:"+tag.CategoryID, nil, &tagCategory)
+				if err != nil {
+					return nil, err
+				}
+				categoryNames[tag.CategoryID] = tagCategory.Name
+			}
+			if categoryNames[tag.CategoryID] != category {
+				continue
+			}
+		}
+
+		var attached []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		err = rest.do("POST", "/com/vmware/cis/tagging/tag-association/id:"+tagID+"?~action=list-attached-objects", nil, &attached)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range attached {
+			objects[types.ManagedObjectReference{Type: object.Type, Value: object.ID}] = true
+		}
+	}
+	return objects, nil
+}
+
+// CategoryTags returns the name of the tag of each of the given categories attached to the objects
+func (rest *RestClient) CategoryTags(categories []string) (map[types.ManagedObjectReference]map[string]string, error) {
+	var tagIDs []string
+	err := rest.do("GET", "/com/vmware/cis/tagging/tag", nil, &tagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, category := range categories {
+		wanted[category] = true
+	}
+	objects := make(map[types.ManagedObjectReference]map[string]string)
+	categoryNames := make(map[string]string)
+	for _, tagID := range tagIDs {
+		var tag struct {
+			Name       string `json:"name"`
+			CategoryID string `json:"category_id"`
+		}
+		err = rest.do("GET", "/com/vmware/cis/tagging/tag/id:"+tagID, nil, &tag)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := categoryNames[tag.CategoryID]; !ok {
+			var tagCategory struct {
+				Name string `json:"name"`
+			}
+			err = rest.do("GET", "/com/vmware/cis/tagging/category/id:"+tag.CategoryID, nil, &tagCategory)
+			if err != nil {
+				return nil, err
+			}
+			categoryNames[tag.CategoryID] = tagCategory.Name
+		}
+		category := categoryNames[tag.CategoryID]
+		if !wanted[category] {
+			continue
+		}
+
+		var attached []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		err = rest.do("POST", "/com/vmware/cis/tagging/tag-association/id:"+tagID+"?~action=list-attached-objects", nil, &attached)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range attached {
+			ref := types.ManagedObjectReference{Type: object.Type, Value: object.ID}
+			if objects[ref] == nil {
+				objects[ref] = make(map[string]string)
+			}
+			objects[ref][category] = tag.Name
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// urlCredentials matches the password of the credentials embedded in a URL, e.g. in a proxy or InfluxDB address
+var urlCredentials = regexp.MustCompile(`(://[^:/@\s]+:)[^/"\s]+@`)
+
+// jsonSecrets matches the values of the password and token settings of the JSON configuration
+var jsonSecrets = regexp.MustCompile(`(?i)("[^"]*(password|token)[^"]*"\s*:\s*)"[^"]*"`)
+
+// minMaskedSecretLength is the length under which secrets are not replaced as raw text, as they would mask
+// unrelated words: they are only masked in URLs and in the password settings of JSON
+const minMaskedSecretLength = 4
+
+// maskedSecrets are the secrets replaced in every log line: the ones of the configuration, set at startup,
+// and the passwords fetched from Vault or rotated into files, added when they are read
+var (
+	maskedSecrets      []string
+	maskedSecretsMutex sync.RWMutex
+)
+
+// addMaskedSecret masks secrets in the log lines written from now on
+func addMaskedSecret(secrets ...string) {
+	maskedSecretsMutex.Lock()
+	defer maskedSecretsMutex.Unlock()
+	for _, secret := range secrets {
+		known := secret == ""
+		for _, masked := range maskedSecrets {
+			known = known || secret == masked
+		}
+		if !known {
+			maskedSecrets = append(maskedSecrets, secret)
+		}
+	}
+}
+
+// SecretMasker masks the secrets of the log lines written to out
+type SecretMasker struct {
+	out io.Writer
+}
+
+// NewSecretMasker wraps a log destination so secrets never reach it
+func NewSecretMasker(out io.Writer) *SecretMasker {
+	return &SecretMasker{out: out}
+}
+
+// Write writes the log line with its secrets masked
+func (masker *SecretMasker) Write(p []byte) (int, error) {
+	maskedSecretsMutex.RLock()
+	text := maskSecrets(string(p), maskedSecrets)
+	maskedSecretsMutex.RUnlock()
+	_, err := io.WriteString(masker.out, text)
+	return len(p), err
+}
+
+// maskSecrets replaces the secrets, the passwords of URLs and the password settings of JSON in text by ***
+func maskSecrets(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if len(secret) >= minMaskedSecretLength {
+			text = strings.Replace(text, secret, "***", -1)
+		}
+	}
+	text = urlCredentials.ReplaceAllString(text, "${1}***@")
+	return jsonSecrets.ReplaceAllString(text, `${1}"***"`)
+}
+
+// configSecrets returns the passwords and tokens of the configuration, including the ones read from the
+// environment and from files at startup
+func configSecrets(config Configuration) []string {
+	secrets := []string{config.InfluxDB.Password, config.Vault.Token}
+	if config.Vault.TokenFile != "" {
+		if token, err := readPasswordFile(config.Vault.TokenFile); err == nil {
+			secrets = append(secrets, token)
+		}
+	}
+	for _, vcenter := range config.VCenters {
+		secrets = append(secrets, vcenter.Password)
+		if vcenter.PasswordEnv != "" {
+			secrets = append(secrets, os.Getenv(vcenter.PasswordEnv))
+		}
+		if vcenter.PasswordFile != "" {
+			if password, err := readPasswordFile(vcenter.PasswordFile); err == nil {
+				secrets = append(secrets, password)
+			}
+		}
+	}
+	for _, output := range config.Outputs {
+		secrets = append(secrets, output.Password)
+	}
+	return secrets
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// Serializer renders a point as newline-terminated text for the outputs writing to files and streams.
+// It returns no bytes when none of the fields of the point can be written in its format.
+type Serializer interface {
+	Serialize(pt *influxclient.Point) ([]byte, error)
+}
+
+// outputFormats are the serialization formats each output type can write, the first one being the default.
+// The InfluxDB, UDP and Graphite transports only accept their own protocol, Prometheus remote write has none.
+var outputFormats = map[string][]string{
+	"influxdb":     {"line"},
+	"influxdb-udp": {"line"},
+	"graphite":     {"graphite"},
+	"prometheus":   {},
+	"file":         {"json", "line", "graphite"},
+	"kafka":        {"json", "line", "graphite"},
+}
+
+// outputFormat returns the format of an output, checking the transport can carry it
+func outputFormat(config OutputConfig) (string, error) {
+	formats := outputFormats[config.Type]
+	if config.Format == "" {
+		if len(formats) == 0 {
+			return "", nil
+		}
+		return formats[0], nil
+	}
+	for _, format := range formats {
+		if config.Format == format {
+			return format, nil
+		}
+	}
+	if len(formats) == 0 {
+		return "", fmt.Errorf("%s output does not support a Format, got %q", config.Type, config.Format)
+	}
+	return "", fmt.Errorf("%s output does not support format %q, expected one of: %s", config.Type, config.Format, strings.Join(formats, ", "))
+}
+
+// NewSerializer creates the serializer of the format of an output
+func NewSerializer(config OutputConfig) (Serializer, error) {
+	format, err := outputFormat(config)
+	if err != nil {
+		return nil, err
+	}
+	numbers := lineProtocol{FloatDecimals: config.FloatDecimals}
+	switch format {
+	case "json":
+		return jsonSerializer{}, nil
+	case "line":
+		return lineSerializer{format: numbers}, nil
+	case "graphite":
+		return graphiteSerializer{Prefix: config.Prefix, TagOrder: config.TagOrder, Tagged: config.Tagged, format: numbers}, nil
+	}
+	return nil, fmt.Errorf("%s output has no serializer", config.Type)
+}
+
+// jsonSerializer writes a point as a JSON record (measurement, tags, fields, time)
+type jsonSerializer struct{}
+
+// fileRecord is the JSON record of a point
+type fileRecord struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// Serialize returns the JSON record of the point
+func (serializer jsonSerializer) Serialize(pt *influxclient.Point) ([]byte, error) {
+	fields, err := pt.Fields()
+	if err != nil {
+		return nil, err
+	}
+	record, err := json.Marshal(fileRecord{Measurement: pt.Name(), Tags: pt.Tags(), Fields: fields, Time: pt.Time()})
+	if err != nil {
+		return nil, err
+	}
+	return append(record, '\n'), nil
+}
+
+// lineSerializer writes a point in line protocol with a nanosecond timestamp
+type lineSerializer struct {
+	format lineProtocol
+}
+
+// Serialize returns the line of the point
+func (serializer lineSerializer) Serialize(pt *influxclient.Point) ([]byte, error) {
+	line, ok := serializer.format.line(pt)
+	if !ok {
+		return nil, nil
+	}
+	return []byte(line + " " + strconv.FormatInt(pt.UnixNano(), 10) + "\n"), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/mo"
+	"golang.org/x/net/context"
+)
+
+// userSessions counts the sessions open on the vCenter by the user of the collector, including the current one.
+// The session list lists every session only for accounts with the Sessions.TerminateSession privilege.
+func userSessions(ctx context.Context, client *govmomi.Client) (int, error) {
+	current, err := client.SessionManager.UserSession(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var sessionManager mo.SessionManager
+	err = client.RetrieveOne(ctx, *client.ServiceContent.SessionManager, []string{"sessionList"}, &sessionManager)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, session := range sessionManager.SessionList {
+		if current != nil && session.UserName == current.UserName {
+			count++
+		}
+	}
+	return count, nil
+}
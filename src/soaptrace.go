@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// soapSecrets match the passwords of the login requests and the session cookies
+var soapSecrets = []*regexp.Regexp{
+	regexp.MustCompile(`(?s)(<(?:\w+:)?password>).*?(</(?:\w+:)?password>)`),
+	regexp.MustCompile(`(?s)(<(?:\w+:)?vcSessionCookie>).*?(</(?:\w+:)?vcSessionCookie>)`),
+	regexp.MustCompile(`(?m)^((?:Set-)?Cookie: )[^\r\n]*()`),
+}
+
+// SoapTrace is a govmomi debug provider appending the SOAP requests and responses to a single rotated file
+type SoapTrace struct {
+	file *RotatingFile
+}
+
+// OpenSoapTrace opens the SOAP trace file, rotated like the log file
+func OpenSoapTrace(path string) (*SoapTrace, error) {
+	file, err := OpenRotatingFile(path, 100*1024*1024, 5)
+	if err != nil {
+		return nil, err
+	}
+	return &SoapTrace{file: file}, nil
+}
+
+// soapTraceEntry buffers a request or response part, written to the trace with its secrets redacted once closed
+type soapTraceEntry struct {
+	bytes.Buffer
+	name  string
+	trace *SoapTrace
+}
+
+// Close appends the entry to the trace in a single write, so concurrent entries do not interleave
+func (entry *soapTraceEntry) Close() error {
+	content := entry.Bytes()
+	for _, secret := range soapSecrets {
+		content = secret.ReplaceAll(content, []byte("${1}REDACTED${2}"))
+	}
+	var record bytes.Buffer
+	fmt.Fprintf(&record, "==> %s %s\n", time.Now().Format(time.RFC3339Nano), entry.name)
+	record.Write(content)
+	record.WriteString("\n\n")
+	_, err := entry.trace.file.Write(record.Bytes())
+	return err
+}
+
+// NewFile returns the entry for a part of a round trip, named like 1-0001.req.xml by govmomi
+func (trace *SoapTrace) NewFile(name string) io.WriteCloser {
+	return &soapTraceEntry{name: name, trace: trace}
+}
+
+// Flush does nothing as entries are written when closed
+func (trace *SoapTrace) Flush() {
+}
+
+// Close closes the trace file
+func (trace *SoapTrace) Close() error {
+	return trace.file.Close()
+}
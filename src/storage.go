@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// storagePodPoints returns a datastore_cluster point per datastore cluster with its capacity and storage DRS
+// settings, along with the datastore cluster of every member datastore by datastore name
+func storagePodPoints(ctx context.Context, pc *property.Collector, podRefs []types.ManagedObjectReference, vcTags map[string]string) ([]*influxclient.Point, map[string]string, error) {
+	var podmo []mo.StoragePod
+	err := pc.Retrieve(ctx, podRefs, []string{"name", "childEntity", "summary", "podStorageDrsEntry"}, &podmo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Resolve the names of the member datastores
+	datastoreRefs := []types.ManagedObjectReference{}
+	datastoreToPod := make(map[types.ManagedObjectReference]string)
+	for _, pod := range podmo {
+		for _, child := range pod.ChildEntity {
+			if child.Type == "Datastore" {
+				datastoreRefs = append(datastoreRefs, child)
+				datastoreToPod[child] = pod.Name
+			}
+		}
+	}
+	datastoreToCluster := make(map[string]string)
+	if len(datastoreRefs) > 0 {
+		var dsmo []mo.Datastore
+		err = pc.Retrieve(ctx, datastoreRefs, []string{"name"}, &dsmo)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ds := range dsmo {
+			datastoreToCluster[ds.Name] = datastoreToPod[ds.Self]
+		}
+	}
+
+	points := []*influxclient.Point{}
+	for _, pod := range podmo {
+		if pod.Summary == nil {
+			continue
+		}
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["datastore_cluster"] = pod.Name
+		fields := map[string]interface{}{
+			"capacity":   pod.Summary.Capacity,
+			"free_space": pod.Summary.FreeSpace,
+			"used_space": pod.Summary.Capacity - pod.Summary.FreeSpace,
+		}
+		if pod.PodStorageDrsEntry != nil {
+			podConfig := pod.PodStorageDrsEntry.StorageDrsConfig.PodConfig
+			fields["sdrs_enabled"] = podConfig.Enabled
+			fields["sdrs_io_load_balance_enabled"] = podConfig.IoLoadBalanceEnabled
+			fields["sdrs_automated"] = podConfig.DefaultVmBehavior == string(types.StorageDrsPodConfigInfoBehaviorAutomated)
+		}
+		pt, err := influxclient.NewPoint("datastore_cluster", tags, fields, time.Now())
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, datastoreToCluster, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tuneTransport applies the connection tunables of the vCenter to the transport of its SOAP client.
+// Large inventories return property collector responses of several megabytes, a larger socket read buffer
+// and more idle connections help with their throughput.
+func (vcenter *VCenter) tuneTransport(transport *http.Transport) {
+	maxIdleConns := vcenter.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = 10
+	}
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	if vcenter.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(vcenter.IdleConnTimeout) * time.Second
+	}
+	if vcenter.ReadBufferSize > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		readBufferSize := vcenter.ReadBufferSize
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				err = tcpConn.SetReadBuffer(readBufferSize)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// UDPOutput writes points to an InfluxDB UDP listener as line protocol.
+// Unlike HTTP writes, a UDP packet cannot carry its precision: the listener reads every timestamp in the precision
+// it is configured with, nanoseconds by default. The timestamps are truncated to the precision of the batch, then
+// written in the precision of the listener, so points land at the same time as through HTTP.
+type UDPOutput struct {
+	conn        net.Conn
+	precision   string
+	payloadSize int
+	format      lineProtocol
+}
+
+// udpPrecisions are the precisions an InfluxDB UDP listener can be configured with
+var udpPrecisions = map[string]bool{"": true, "n": true, "ns": true, "u": true, "ms": true, "s": true, "m": true, "h": true}
+
+// NewUDPOutput creates a UDP output from its configuration, Precision being the one of the listener
+func NewUDPOutput(config OutputConfig) (*UDPOutput, error) {
+	if !udpPrecisions[config.Precision] {
+		return nil, fmt.Errorf("unknown UDP precision: %q", config.Precision)
+	}
+	_, err := outputFormat(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Precision == "" {
+		stdlog.Println("UDP output ", config.Hostname, " has no Precision, writing nanosecond timestamps as expected by default listeners")
+	}
+	port := config.Port
+	if port == 0 {
+		port = 8089
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(config.Hostname, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return &UDPOutput{conn: conn, precision: config.Precision, payloadSize: influxclient.UDPPayloadSize, format: lineProtocol{FloatDecimals: config.FloatDecimals}}, nil
+}
+
+// Write sends the points in as few packets as the payload size allows
+func (output *UDPOutput) Write(bp influxclient.BatchPoints) error {
+	batchMultiplier := batchPrecisionMultiplier(bp.Precision())
+	listenerMultiplier := models.GetPrecisionMultiplier(output.precision)
+
+	packet := make([]byte, 0, output.payloadSize)
+	for _, pt := range bp.Points() {
+		line, ok := output.format.line(pt)
+		if !ok {
+			continue
+		}
+		if !pt.Time().IsZero() {
+			nanoseconds := pt.UnixNano()
+			nanoseconds -= nanoseconds % batchMultiplier
+			line += " " + strconv.FormatInt(nanoseconds/listenerMultiplier, 10)
+		}
+		if len(packet) > 0 && len(packet)+len(line)+1 > output.payloadSize {
+			_, err := output.conn.Write(packet)
+			if err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		packet = append(packet, line...)
+		packet = append(packet, '\n')
+	}
+	if len(packet) > 0 {
+		_, err := output.conn.Write(packet)
+		return err
+	}
+	return nil
+}
+
+// batchPrecisionMultiplier returns the nanoseconds of the precision of a batch, a duration unit such as "us"
+// unlike the listener precisions
+func batchPrecisionMultiplier(precision string) int64 {
+	d, err := time.ParseDuration("1" + precision)
+	if precision == "" || err != nil || d <= 0 {
+		return 1
+	}
+	return int64(d)
+}
+
+// Close closes the UDP socket
+func (output *UDPOutput) Close() error {
+	return output.conn.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// packetConn records the packets written to a connection
+type packetConn struct {
+	net.Conn
+	packets []string
+}
+
+func (conn *packetConn) Write(p []byte) (int, error) {
+	conn.packets = append(conn.packets, string(p))
+	return len(p), nil
+}
+
+func udpBatch(t *testing.T, precision string, times ...time.Time) influxclient.BatchPoints {
+	bp, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: "vsphere", Precision: precision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range times {
+		pt, err := influxclient.NewPoint("cpu", map[string]string{"name": "vm1"}, map[string]interface{}{"usage": int64(1)}, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.AddPoint(pt)
+	}
+	return bp
+}
+
+func TestUDPOutputPrecision(t *testing.T) {
+	ts := time.Unix(0, 1500000000123456789)
+	cases := []struct {
+		batch    string
+		listener string
+		expected string
+	}{
+		// The batch and the listener in the same precision
+		{"", "", "1500000000123456789"},
+		{"ns", "n", "1500000000123456789"},
+		{"ns", "ns", "1500000000123456789"},
+		{"us", "u", "1500000000123456"},
+		{"ms", "ms", "1500000000123"},
+		{"s", "s", "1500000000"},
+		{"m", "m", "25000000"},
+		{"h", "h", "416666"},
+		// A listener in nanoseconds, the default, gets the timestamps truncated to the batch precision
+		{"us", "", "1500000000123456000"},
+		{"ms", "", "1500000000123000000"},
+		{"s", "", "1500000000000000000"},
+		{"m", "", "1500000000000000000"},
+		{"h", "", "1499997600000000000"},
+		// A listener coarser than the batch truncates again
+		{"ms", "s", "1500000000"},
+		// A listener finer than the batch keeps the truncation of the batch
+		{"s", "ms", "1500000000000"},
+	}
+	for _, c := range cases {
+		conn := &packetConn{}
+		output := &UDPOutput{conn: conn, precision: c.listener, payloadSize: influxclient.UDPPayloadSize}
+		err := output.Write(udpBatch(t, c.batch, ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "cpu,name=vm1 usage=1i " + c.expected + "\n"
+		if len(conn.packets) != 1 || conn.packets[0] != expected {
+			t.Errorf("batch %q, listener %q: packets = %q, expected %q", c.batch, c.listener, conn.packets, expected)
+		}
+	}
+}
+
+func TestUDPOutputPayloadSize(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	line := "cpu,name=vm1 usage=1i 1500000000\n"
+	conn := &packetConn{}
+	output := &UDPOutput{conn: conn, precision: "s", payloadSize: 2 * len(line)}
+	err := output.Write(udpBatch(t, "s", ts, ts, ts, ts, ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{strings.Repeat(line, 2), strings.Repeat(line, 2), line}
+	if len(conn.packets) != len(expected) {
+		t.Fatalf("packets = %q, expected %q", conn.packets, expected)
+	}
+	for i := range expected {
+		if conn.packets[i] != expected[i] {
+			t.Errorf("packet %d = %q, expected %q", i, conn.packets[i], expected[i])
+		}
+	}
+}
+
+func TestNewUDPOutputRejectsUnknownPrecision(t *testing.T) {
+	if _, err := NewUDPOutput(OutputConfig{Type: "influxdb-udp", Hostname: "localhost", Precision: "d"}); err == nil {
+		t.Error("NewUDPOutput accepted precision d")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// controllerType returns the type of a disk controller
+func controllerType(device types.BaseVirtualDevice) string {
+	switch device.(type) {
+	case *types.ParaVirtualSCSIController:
+		return "pvscsi"
+	case *types.VirtualLsiLogicController:
+		return "lsilogic"
+	case *types.VirtualLsiLogicSASController:
+		return "lsilogic-sas"
+	case *types.VirtualBusLogicController:
+		return "buslogic"
+	case *types.VirtualAHCIController, *types.VirtualSATAController:
+		return "sata"
+	case *types.VirtualIDEController:
+		return "ide"
+	case *types.VirtualNVMEController:
+		return "nvme"
+	}
+	return "unknown"
+}
+
+// vdiskPoints returns a vm_vdisk point per virtual disk with its provisioned size and provisioning type
+func vdiskPoints(vmmo []mo.VirtualMachine, config Configuration, vcTags map[string]string) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, vm := range vmmo {
+		if vm.Config == nil {
+			continue
+		}
+
+		// Index the controllers to resolve the controller of each disk
+		controllers := make(map[int32]types.BaseVirtualDevice)
+		for _, device := range vm.Config.Hardware.Device {
+			controllers[device.GetVirtualDevice().Key] = device
+		}
+
+		for _, device := range vm.Config.Hardware.Device {
+			disk, ok := device.(*types.VirtualDisk)
+			if !ok {
+				continue
+			}
+			tags := make(map[string]string)
+			for k, v := range vcTags {
+				tags[k] = v
+			}
+			tags["name"] = strings.ToLower(config.stripName(vm.Summary.Config.Name))
+			if disk.DeviceInfo != nil {
+				tags["disk"] = disk.DeviceInfo.GetDescription().Label
+			}
+			tags["controller"] = "unknown"
+			if controller, ok := controllers[disk.ControllerKey]; ok {
+				tags["controller"] = controllerType(controller)
+			}
+
+			capacity := disk.CapacityInBytes
+			if capacity == 0 {
+				capacity = disk.CapacityInKB * 1024
+			}
+			thin := false
+			if backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo); ok {
+				thin = boolValue(backing.ThinProvisioned)
+			}
+			fields := map[string]interface{}{
+				"capacity":         capacity,
+				"thin_provisioned": thin,
+			}
+			pt, err := influxclient.NewPoint("vm_vdisk", tags, fields, now)
+			if err != nil {
+				errlog.Println(err)
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+	return points
+}
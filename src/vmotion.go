@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// eventPageSize is the number of events read per page from the event collector
+const eventPageSize = 1000
+
+// migrationEvents returns the VM migration events, manual or initiated by DRS, between begin and end
+func migrationEvents(ctx context.Context, client *vim25.Client, begin time.Time, end time.Time) ([]types.BaseEvent, error) {
+	return readEvents(ctx, client, begin, end, []string{"VmMigratedEvent", "DrsVmMigratedEvent"})
+}
+
+// readEvents returns the events of the given types between begin and end
+func readEvents(ctx context.Context, client *vim25.Client, begin time.Time, end time.Time, eventTypes []string) ([]types.BaseEvent, error) {
+	req := types.CreateCollectorForEvents{
+		This: *client.ServiceContent.EventManager,
+		Filter: types.EventFilterSpec{
+			Time:        &types.EventFilterSpecByTime{BeginTime: &begin, EndTime: &end},
+			EventTypeId: eventTypes,
+		},
+	}
+	res, err := methods.CreateCollectorForEvents(ctx, client.RoundTripper, &req)
+	if err != nil {
+		return nil, err
+	}
+	collector := res.Returnval
+	defer methods.DestroyCollector(ctx, client.RoundTripper, &types.DestroyCollector{This: collector})
+
+	// Read every page, the collector keeps its position between reads
+	events := []types.BaseEvent{}
+	for {
+		page, err := methods.ReadNextEvents(ctx, client.RoundTripper, &types.ReadNextEvents{This: collector, MaxCount: eventPageSize})
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Returnval) == 0 {
+			return events, nil
+		}
+		events = append(events, page.Returnval...)
+	}
+}
+
+// vmotionPoints returns a vmotion point per migrated VM, source and destination, with the number of migrations
+func vmotionPoints(events []types.BaseEvent, config Configuration, vcTags map[string]string, now time.Time) []*influxclient.Point {
+	counts := make(map[string]int64)
+	migrationTags := make(map[string]map[string]string)
+	for _, baseEvent := range events {
+		var event *types.VmMigratedEvent
+		drs := false
+		switch migration := baseEvent.(type) {
+		case *types.VmMigratedEvent:
+			event = migration
+		case *types.DrsVmMigratedEvent:
+			event = &migration.VmMigratedEvent
+			drs = true
+		default:
+			continue
+		}
+		if event.Vm == nil {
+			continue
+		}
+
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["name"] = strings.ToLower(config.stripName(event.Vm.Name))
+		tags["drs"] = strconv.FormatBool(drs)
+		if event.SourceHost.Name != "" {
+			tags["source_host"] = event.SourceHost.Name
+		}
+		if event.Host != nil {
+			tags[config.esxTagKey()] = event.Host.Name
+		}
+		if event.ComputeResource != nil {
+			tags["cluster"] = event.ComputeResource.Name
+		}
+
+		key := tagSetKey(tags)
+		counts[key]++
+		migrationTags[key] = tags
+	}
+
+	points := []*influxclient.Point{}
+	for key, count := range counts {
+		pt, err := influxclient.NewPoint("vmotion", migrationTags[key], map[string]interface{}{"count": count}, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
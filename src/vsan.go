@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// vsanPoints returns a vsan point per vSAN enabled cluster with the capacity of its vSAN datastore and
+// its disk groups, the congestion of its disks and the objects it is resyncing.
+// The congestion and resync statistics are queried from the vSAN internal system of the connected hosts.
+func vsanPoints(ctx context.Context, client *vim25.Client, pc *property.Collector, clusterRefs []types.ManagedObjectReference, vcTags map[string]string) ([]*influxclient.Point, error) {
+	var clmo []mo.ClusterComputeResource
+	err := pc.Retrieve(ctx, clusterRefs, []string{"name", "configurationEx", "host", "datastore"}, &clmo)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for _, cl := range clmo {
+		configEx, ok := cl.ConfigurationEx.(*types.ClusterConfigInfoEx)
+		if !ok || configEx.VsanConfigInfo == nil || !boolValue(configEx.VsanConfigInfo.Enabled) {
+			continue
+		}
+
+		fields := make(map[string]interface{})
+
+		// Capacity of the vSAN datastore of the cluster
+		if len(cl.Datastore) > 0 {
+			var dsmo []mo.Datastore
+			err = pc.Retrieve(ctx, cl.Datastore, []string{"summary"}, &dsmo)
+			if err != nil {
+				return nil, err
+			}
+			for _, ds := range dsmo {
+				if ds.Summary.Type != "vsan" {
+					continue
+				}
+				fields["capacity"] = ds.Summary.Capacity
+				fields["free_space"] = ds.Summary.FreeSpace
+				fields["used_space"] = ds.Summary.Capacity - ds.Summary.FreeSpace
+			}
+		}
+
+		// Disk groups claimed by vSAN on the hosts of the cluster, each with one cache disk
+		var diskGroups, capacityDisks, rawCapacity int64
+		if len(cl.Host) > 0 {
+			var hsmo []mo.HostSystem
+			err = pc.Retrieve(ctx, cl.Host, []string{"name", "config.vsanHostConfig", "configManager.vsanInternalSystem", "runtime.connectionState"}, &hsmo)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range hsmo {
+				if host.Config == nil || host.Config.VsanHostConfig == nil || host.Config.VsanHostConfig.StorageInfo == nil {
+					continue
+				}
+				for _, diskGroup := range host.Config.VsanHostConfig.StorageInfo.DiskMapping {
+					diskGroups++
+					for _, disk := range diskGroup.NonSsd {
+						capacityDisks++
+						rawCapacity += disk.Capacity.Block * int64(disk.Capacity.BlockSize)
+					}
+				}
+			}
+
+			// Congestion of the disks and resync of the cluster
+			addVsanInternalFields(ctx, client, fields, hsmo)
+		}
+		fields["disk_group_count"] = diskGroups
+		fields["capacity_disk_count"] = capacityDisks
+		fields["raw_capacity"] = rawCapacity
+
+		tags := make(map[string]string)
+		for k, v := range vcTags {
+			tags[k] = v
+		}
+		tags["cluster"] = cl.Name
+		pt, err := influxclient.NewPoint("vsan", tags, fields, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points, nil
+}
+
+// addVsanInternalFields adds the highest congestion of the disks of the hosts and the resync statistics of the
+// cluster. The cluster-wide resync is queried from the first host answering it. A host failing to answer is
+// skipped with a warning rather than failing the collection of the cluster.
+func addVsanInternalFields(ctx context.Context, client *vim25.Client, fields map[string]interface{}, hosts []mo.HostSystem) {
+	var congestion int64
+	congestionFound, resyncFound := false, false
+	for _, host := range hosts {
+		if host.ConfigManager.VsanInternalSystem == nil || host.Runtime.ConnectionState != types.HostSystemConnectionStateConnected {
+			continue
+		}
+		internalSystem := *host.ConfigManager.VsanInternalSystem
+
+		statistics, err := methods.QueryVsanStatistics(ctx, client, &types.QueryVsanStatistics{This: internalSystem, Labels: []string{"lsom"}})
+		if err == nil {
+			var hostCongestion int64
+			var ok bool
+			hostCongestion, ok, err = vsanCongestion(statistics.Returnval)
+			if ok && (!congestionFound || hostCongestion > congestion) {
+				congestion = hostCongestion
+				congestionFound = true
+			}
+		}
+		if err != nil {
+			errlog.Println("Warning: could not retrieve the vSAN congestion of host: ", host.Name)
+			errlog.Println("Error: ", err)
+		}
+
+		if resyncFound {
+			continue
+		}
+		syncing, err := methods.QuerySyncingVsanObjects(ctx, client, &types.QuerySyncingVsanObjects{This: internalSystem})
+		if err == nil {
+			var objects, bytes int64
+			objects, bytes, err = vsanResync(syncing.Returnval)
+			if err == nil {
+				fields["resync_objects"] = objects
+				fields["resync_bytes"] = bytes
+				resyncFound = true
+			}
+		}
+		if err != nil {
+			errlog.Println("Warning: could not retrieve the vSAN resync of host: ", host.Name)
+			errlog.Println("Error: ", err)
+		}
+	}
+	if congestionFound {
+		fields["congestion"] = congestion
+	}
+}
+
+// vsanCongestion returns the highest congestion, from 0 to 255, in the LSOM statistics of a host: the
+// *Congestion values of its disks, such as ssdCongestion or logCongestion. It returns false when there are none.
+func vsanCongestion(statistics string) (int64, bool, error) {
+	var data interface{}
+	err := json.Unmarshal([]byte(statistics), &data)
+	if err != nil {
+		return 0, false, err
+	}
+	var highest int64
+	found := false
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				if number, ok := child.(float64); ok && strings.HasSuffix(strings.ToLower(key), "congestion") {
+					if !found || int64(number) > highest {
+						highest = int64(number)
+					}
+					found = true
+					continue
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(data)
+	return highest, found, nil
+}
+
+// vsanResync returns the count of DOM objects being resynced and the bytes left to sync of their components
+func vsanResync(syncing string) (int64, int64, error) {
+	var data struct {
+		DomObjects map[string]interface{} `json:"dom_objects"`
+	}
+	err := json.Unmarshal([]byte(syncing), &data)
+	if err != nil {
+		return 0, 0, err
+	}
+	var bytes int64
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if attributes, ok := v["attributes"].(map[string]interface{}); ok {
+				if toSync, ok := attributes["bytesToSync"].(float64); ok {
+					bytes += int64(toSync)
+				}
+			}
+			for key, child := range v {
+				if key != "attributes" {
+					walk(child)
+				}
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	for _, object := range data.DomObjects {
+		walk(object)
+	}
+	return int64(len(data.DomObjects)), bytes, nil
+}
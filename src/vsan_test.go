@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestVsanCongestion(t *testing.T) {
+	cases := []struct {
+		name       string
+		statistics string
+		congestion int64
+		found      bool
+	}{
+		{"highest of the disks", `{"lsom": {"disks": {
+			"52a1": {"info": {"ssdCongestion": 12, "logCongestion": 0, "capacityUsed": 900}},
+			"52b2": {"info": {"ssdCongestion": 3, "memCongestion": 64, "slabCongestion": 1}}}}}`, 64, true},
+		{"idle disks", `{"lsom": {"disks": {"52a1": {"info": {"ssdCongestion": 0}}}}}`, 0, true},
+		{"disk list", `{"lsom": {"disks": [{"iopsCongestion": 7}, {"compCongestion": 30}]}}`, 30, true},
+		{"no congestion", `{"lsom": {"disks": {"52a1": {"info": {"capacityUsed": 900}}}}}`, 0, false},
+		{"empty", `{}`, 0, false},
+	}
+	for _, c := range cases {
+		congestion, found, err := vsanCongestion(c.statistics)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if congestion != c.congestion || found != c.found {
+			t.Errorf("%s: vsanCongestion = %d, %v, expected %d, %v", c.name, congestion, found, c.congestion, c.found)
+		}
+	}
+	if _, _, err := vsanCongestion("not json"); err == nil {
+		t.Error("vsanCongestion accepted invalid statistics")
+	}
+}
+
+func TestVsanResync(t *testing.T) {
+	syncing := `{
+		"dom_objects": {
+			"5c1a": {"config": {"content": {"type": "Configuration", "attributes": {},
+				"child-1": {"type": "RAID_1", "attributes": {},
+					"child-1": {"type": "Component", "componentUuid": "c1", "attributes": {"bytesToSync": 1073741824}},
+					"child-2": {"type": "Component", "componentUuid": "c2", "attributes": {"bytesToSync": 536870912}}}}}},
+			"5c2b": {"config": {"content": {"type": "RAID_1",
+				"child-1": {"type": "Component", "componentUuid": "c3", "attributes": {"bytesToSync": 1024}},
+				"child-2": {"type": "Component", "componentUuid": "c4", "attributes": {"componentState": 5}}}}}
+		},
+		"lsom_objects": {"c1": {"attributes": {"bytesToSync": 1073741824}}}
+	}`
+	objects, bytes, err := vsanResync(syncing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 2 {
+		t.Errorf("resync objects = %d, expected 2", objects)
+	}
+	if expected := int64(1073741824 + 536870912 + 1024); bytes != expected {
+		t.Errorf("resync bytes = %d, expected %d", bytes, expected)
+	}
+
+	objects, bytes, err = vsanResync(`{"dom_objects": {}, "lsom_objects": {}}`)
+	if err != nil || objects != 0 || bytes != 0 {
+		t.Errorf("vsanResync without resync = %d, %d, %v, expected 0, 0", objects, bytes, err)
+	}
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	influxclient "github.com/influxdata/influxdb/client/v2"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	govmomidebug "github.com/vmware/govmomi/vim25/debug"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 	"golang.org/x/net/context"
 )
@@ -31,34 +49,194 @@ const (
 
 // Configuration is used to store config data
 type Configuration struct {
-	VCenters []*VCenter
-	Metrics  []Metric
-	Interval int
-	Domain   string
-	InfluxDB InfluxDB
+	VCenters             []*VCenter
+	Metrics              []Metric
+	Interval             int
+	Presets              []string
+	CounterRefreshCycles int
+	IntervalMultipliers  map[string]int
+	ExcludeFields        []string
+	ExcludeGroups        []string
+	Processors           []string
+	Priorities           []string
+	VCenterTagKey        string
+	EsxTagKey            string
+	UnknownEsxTag        string
+	LegacyHostTag        bool
+	GuestTags            bool
+	MaxPointsPerCycle    int
+	MaxPointsAction      string
+	MinPointsPerCycle    int
+	MaxEntitiesPerType   int
+	MeasurementNames     map[string]string
+	OverlapSeconds       int
+	ContinueWindow       bool
+	ShareRollups         bool
+	MinSamples           int
+	MeasurementRouting   map[string]string
+	CycleRetries         int
+	CycleRetryDelay      int
+	EmptyPerfRetryDelay  int
+	MaxSample            int
+	MaxConcurrentViews   int
+	PropertyFaults       string
+	NameCacheCycles      int
+	MaxClockSkew         int
+	UseVCenterClock      bool
+	PerfCoverage         bool
+	AlignTimestamps      bool
+	Rollups              map[string]string
+	RollupSuffixes       bool
+	MinCounterLevel      int
+	MaxCounterLevel      int
+	TagFilter            TagFilter
+	Ownership            Ownership
+	InstanceCap          InstanceCap
+	Decimals             *int
+	Collect              Collect
+	MonitoredServices    []string
+	MonitoredRulesets    []string
+	Domain               string
+	NameStripRegex       string
+	NameTags             NameTags
+	InfluxDB             InfluxDB
+	Outputs              []OutputConfig
+	Vault                Vault
+	Exporter             Exporter
+	AuditLog             string
+	DatastoreFallback    bool
+	TagValueRewrites     map[string][]TagValueRewrite
+	CardinalityReduction map[string][]string
+	nameStrip            *regexp.Regexp
+	cardinalityRules     map[string][]TagValueRewrite
+	fingerprint          string
+	audit                *AuditLog
 }
 
 // InfluxDB is used for InfluxDB connections
 type InfluxDB struct {
-	Hostname string
-	Username string
-	Password string
-	Database string
+	Hostname            string
+	Username            string
+	Password            string
+	PasswordFile        string
+	Database            string
+	WarnOnPingFailure   bool
+	FlushInterval       int
+	FlushSize           int
+	MaxBufferSize       int
+	DropPolicy          string
+	DrainTimeout        int
+	ClientCertFile      string
+	ClientKeyFile       string
+	CAFile              string
+	WritePath           string
+	MaxConcurrentWrites int
+	ChunkSize           int
+	ChunkRetries        int
+	Proxy               string
 }
 
 // VCenter for VMware vCenter connections
 type VCenter struct {
-	Hostname     string
-	Username     string
-	Password     string
-	MetricGroups []*MetricGroup
+	Hostname        string
+	Hostnames       []string
+	Username        string
+	Password        string
+	PasswordFile    string
+	PasswordEnv     string
+	ApiVersion      string
+	KeepAlive       int
+	MaxSessionAge   int
+	IntervalID      int
+	MaxIdleConns    int
+	IdleConnTimeout int
+	ReadBufferSize  int
+	Metrics         []Metric
+	MetricGroups    []*MetricGroup
+
+	client          *govmomi.Client
+	loginTime       time.Time
+	instanceUUID    string
+	cycle           int
+	counterHash     uint64
+	initFailed      bool
+	lastSamples     map[types.ManagedObjectReference]time.Time
+	lastEndTime     time.Time
+	lastEvents      time.Time
+	lastStateEvents time.Time
+	lastEventKey    int32
+	perfChunkSize   int
+	licenseDenied   bool
+	sessionsDenied  bool
+	names           map[types.ManagedObjectReference]string
+	paths           map[types.ManagedObjectReference]string
+	namesCycle      int
+	tagged          map[types.ManagedObjectReference]bool
+	taggedCycle     int
+	clockSkew       time.Duration
+	skewMeasured    bool
+	sampledEntities map[types.ManagedObjectReference]bool
+	credentials     CredentialProvider
 }
 
 // MetricDef metric definition
 type MetricDef struct {
-	Metric    string
-	Instances string
-	Key       int32
+	Metric          string
+	Instances       string
+	Decimals        *int
+	Tags            map[string]string
+	MinSamples      int
+	AllowNegative   bool
+	Downsample      int
+	Scale           float64
+	RetentionPolicy string
+	Key             int32
+}
+
+// Collect toggles the optional collections
+type Collect struct {
+	HostServices      bool
+	Network           bool
+	Alarms            bool
+	VirtualDisks      bool
+	Numa              bool
+	VmTuning          bool
+	VmCapabilities    bool
+	ContentLibrary    bool
+	HostHardware      bool
+	Vsan              bool
+	HostBuild         bool
+	HostTime          bool
+	Vmotion           bool
+	License           bool
+	Events            bool
+	DatastoreCapacity bool
+	ResourcePools     *bool
+}
+
+// resourcePools tells if resource pools are collected, which they are unless disabled
+func (collect Collect) resourcePools() bool {
+	return collect.ResourcePools == nil || *collect.ResourcePools
+}
+
+// TagValueRewrite replaces the matches of a regular expression in the values of a tag
+type TagValueRewrite struct {
+	Pattern     string
+	Replacement string
+	pattern     *regexp.Regexp
+}
+
+// NameTags adds tags with other names of the entities
+type NameTags struct {
+	Full          bool
+	InventoryPath bool
+}
+
+// TagFilter restricts collection to the entities bearing a vSphere tag
+type TagFilter struct {
+	Category      string
+	Name          string
+	RefreshCycles int
 }
 
 // Metric is used for metrics retrieval
@@ -74,6 +252,22 @@ type MetricGroup struct {
 	Mor        []types.ManagedObjectReference
 }
 
+// hasMetric tells if the group already queries the counter of a metric for the same instances
+func (metricgroup *MetricGroup) hasMetric(metricdef MetricDef) bool {
+	for _, existing := range metricgroup.Metrics {
+		if existing.Key == metricdef.Key && existing.Instances == metricdef.Instances {
+			return true
+		}
+	}
+	return false
+}
+
+// metricKey identifies a counter queried for an object type
+type metricKey struct {
+	ObjectType string
+	Key        int32
+}
+
 // EntityQuery are informations to query about an entity
 type EntityQuery struct {
 	Name    string
@@ -81,6 +275,98 @@ type EntityQuery struct {
 	Metrics []int32
 }
 
+// RPCTimings records the wall-clock time and number of vCenter calls per object type
+type RPCTimings struct {
+	Durations map[string]time.Duration
+	Calls     map[string]int64
+}
+
+// NewRPCTimings returns empty RPC timings
+func NewRPCTimings() *RPCTimings {
+	return &RPCTimings{Durations: make(map[string]time.Duration), Calls: make(map[string]int64)}
+}
+
+// Track adds the time elapsed since start to the given object type
+func (timings *RPCTimings) Track(objectType string, start time.Time) {
+	timings.Durations[objectType] += time.Since(start)
+	timings.Calls[objectType]++
+}
+
+// Fields returns the timings as InfluxDB fields
+func (timings *RPCTimings) Fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	for objectType, duration := range timings.Durations {
+		key := strings.ToLower(objectType)
+		fields[key+"_duration_ms"] = int64(duration / time.Millisecond)
+		fields[key+"_calls"] = timings.Calls[objectType]
+	}
+	return fields
+}
+
+// version of the collector, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// CollectorStatus sums up a collection cycle of a vCenter
+type CollectorStatus struct {
+	Start         time.Time
+	Points        int
+	WriteDuration time.Duration
+	ClockSkew     time.Duration
+	Lag           time.Duration
+	Sessions      int
+	Entities      map[string]int
+	Measurements  map[string]int
+	Success       bool
+}
+
+// NewCollectorStatus returns the status of a cycle starting now
+func NewCollectorStatus() *CollectorStatus {
+	return &CollectorStatus{Start: time.Now(), Lag: -time.Millisecond, Sessions: -1, Entities: make(map[string]int), Measurements: make(map[string]int)}
+}
+
+// Fields returns the status as InfluxDB fields, every field is always present
+func (status *CollectorStatus) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"success":                status.Success,
+		"points_written":         int64(status.Points),
+		"write_duration_ms":      int64(status.WriteDuration / time.Millisecond),
+		"collection_duration_ms": int64(time.Since(status.Start) / time.Millisecond),
+		"clock_skew_ms":          int64(status.ClockSkew / time.Millisecond),
+		"collection_lag_ms":      int64(status.Lag / time.Millisecond),
+		"sessions":               int64(status.Sessions),
+		"points_dropped":         atomic.LoadInt64(&droppedPoints),
+	}
+	for _, objectType := range []string{"VirtualMachine", "HostSystem", "ClusterComputeResource", "ResourcePool", "DistributedVirtualPortgroup", "Datastore", "StoragePod"} {
+		fields["entities_"+strings.ToLower(objectType)] = int64(status.Entities[objectType])
+	}
+	return fields
+}
+
+// realtimeRetention is how long vCenter keeps the real-time (20 second) samples
+const realtimeRetention = time.Hour
+
+// Exit codes of a single collection, errlog.Fatalln exits with exitConfigError
+const (
+	exitSuccess       = 0
+	exitConfigError   = 1
+	exitTooFewPoints  = 2
+	exitPartialFailed = 3
+	exitAllFailed     = 4
+	exitInfluxDBError = 5
+)
+
+// errEmptyCollection reports a collection written with fewer points than MinPointsPerCycle
+var errEmptyCollection = errors.New("collection produced too few points")
+
+// writeError reports a collection whose points could not be written to the outputs
+type writeError struct {
+	err error
+}
+
+func (e writeError) Error() string {
+	return "could not write the points: " + e.err.Error()
+}
+
 var debug bool
 var stdlog, errlog *log.Logger
 
@@ -90,36 +376,216 @@ func (vcenter *VCenter) Connect() (*govmomi.Client, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Log in again once the cached session is older than MaxSessionAge seconds, even if it is still valid
+	if vcenter.client != nil && vcenter.MaxSessionAge > 0 && time.Since(vcenter.loginTime) > time.Duration(vcenter.MaxSessionAge)*time.Second {
+		stdlog.Println("session of vcenter: ", vcenter.Hostname, " is older than MaxSessionAge, logging in again")
+		vcenter.client.Logout(ctx)
+		vcenter.client = nil
+	}
+
+	// Reuse the cached session while it is still valid
+	if vcenter.client != nil {
+		userSession, err := vcenter.client.SessionManager.UserSession(ctx)
+		if err == nil && userSession != nil {
+			return vcenter.client, nil
+		}
+		stdlog.Println("session expired on vcenter: " + vcenter.Hostname)
+		vcenter.client = nil
+	}
+
+	addresses := vcenter.addresses()
+	if len(addresses) == 0 {
+		return nil, errors.New("vcenter has no Hostname or Hostnames to connect to")
+	}
+
 	stdlog.Println("connecting to vcenter: " + vcenter.Hostname)
-	u, err := url.Parse("https://" + vcenter.Username + ":" + vcenter.Password + "@" + vcenter.Hostname + "/sdk")
+	username, password, err := vcenter.Credentials()
 	if err != nil {
-		errlog.Println("Could not parse vcenter url: ", vcenter.Hostname)
+		errlog.Println("Could not get the credentials of vcenter: ", vcenter.Hostname)
 		errlog.Println("Error: ", err)
 		return nil, err
 	}
 
-	client, err := govmomi.NewClient(ctx, u, true)
+	// Try the fallback addresses in order until one of them accepts the login
+	var client *govmomi.Client
+	for i, address := range addresses {
+		client, err = vcenter.connectTo(ctx, address, username, password)
+		if err == nil {
+			if address != vcenter.Hostname {
+				stdlog.Println("connected to vcenter: ", vcenter.Hostname, " through ", address)
+			}
+			break
+		}
+		if i < len(addresses)-1 {
+			stdlog.Println("could not connect to vcenter: ", vcenter.Hostname, " through ", address, ", trying ", addresses[i+1])
+		}
+	}
 	if err != nil {
-		errlog.Println("Could not connect to vcenter: ", vcenter.Hostname)
+		return nil, err
+	}
+
+	// Measure the clock skew once per session, it drifts slowly
+	skew, err := clockSkew(ctx, client.Client)
+	if err != nil {
+		errlog.Println("Could not get the current time of vcenter: ", vcenter.Hostname)
+		errlog.Println("Error: ", err)
+	} else {
+		vcenter.clockSkew = skew
+		vcenter.skewMeasured = true
+	}
+
+	if vcenter.KeepAlive > 0 {
+		vcenter.client = client
+		vcenter.loginTime = time.Now()
+	}
+
+	return client, nil
+}
+
+// addresses returns the addresses of the vCenter, its Hostname followed by the fallback Hostnames
+func (vcenter *VCenter) addresses() []string {
+	addresses := []string{}
+	if vcenter.Hostname != "" {
+		addresses = append(addresses, vcenter.Hostname)
+	}
+	for _, hostname := range vcenter.Hostnames {
+		if hostname != "" && hostname != vcenter.Hostname {
+			addresses = append(addresses, hostname)
+		}
+	}
+	return addresses
+}
+
+// connectTo logs in to the vCenter through one of its addresses
+func (vcenter *VCenter) connectTo(ctx context.Context, address string, username string, password string) (*govmomi.Client, error) {
+	u, err := url.Parse("https://" + address + "/sdk")
+	if err != nil {
+		errlog.Println("Could not parse vcenter url: ", address)
+		errlog.Println("Error: ", err)
+		return nil, err
+	}
+	u.User = url.UserPassword(username, password)
+
+	soapClient := soap.NewClient(u, true)
+	if transport, ok := soapClient.Client.Transport.(*http.Transport); ok {
+		vcenter.tuneTransport(transport)
+	}
+	if vcenter.ApiVersion != "" {
+		soapClient.Version = vcenter.ApiVersion
+	}
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil && vcenter.ApiVersion == "" && soap.IsSoapFault(err) {
+		// Older vCenters fault on a newer vim25 namespace, retry with the oldest supported one
+		stdlog.Println("vcenter ", address, " rejected API version ", soapClient.Version, ", retrying with ", soap.DefaultMinVimVersion)
+		soapClient.Version = soap.DefaultMinVimVersion
+		vimClient, err = vim25.NewClient(ctx, soapClient)
+	}
+	if err != nil {
+		errlog.Println("Could not connect to vcenter: ", address)
 		errlog.Println("Error: ", err)
 		return nil, err
 	}
 
+	// Downgrade to the API version of the vCenter when it is older than ours
+	apiVersion := vimClient.ServiceContent.About.ApiVersion
+	if vcenter.ApiVersion == "" && apiVersion != "" && versionLess(apiVersion, soapClient.Version) {
+		if debug == true {
+			stdlog.Println("Using API version ", apiVersion, " for vcenter: ", address)
+		}
+		soapClient.Version = apiVersion
+	}
+
+	// Keep the session warm between collections
+	if vcenter.KeepAlive > 0 {
+		vimClient.RoundTripper = session.KeepAlive(vimClient.RoundTripper, time.Duration(vcenter.KeepAlive)*time.Second)
+	}
+
+	client := &govmomi.Client{Client: vimClient, SessionManager: session.NewManager(vimClient)}
+	err = client.Login(ctx, u.User)
+	if err != nil {
+		errlog.Println("Could not login to vcenter: ", address)
+		errlog.Println("Error: ", err)
+		return nil, err
+	}
 	return client, nil
 }
 
+// Credentials returns the credentials of the vCenter from its provider, its configuration by default
+func (vcenter *VCenter) Credentials() (string, string, error) {
+	if vcenter.credentials == nil {
+		vcenter.credentials = ConfigCredentials{Username: vcenter.Username, Password: vcenter.Password, PasswordEnv: vcenter.PasswordEnv, PasswordFile: vcenter.PasswordFile}
+	}
+	username, password, err := vcenter.credentials.GetCredentials(vcenter.Hostname)
+	if err != nil {
+		return "", "", err
+	}
+	// Secrets often only hold the password, the username is then the configured one
+	if username == "" {
+		username = vcenter.Username
+	}
+	if username == "" {
+		return "", "", errors.New("no username for vcenter " + vcenter.Hostname + ": set its Username or the username key of its secret")
+	}
+	// Passwords fetched from Vault or rotated into a file are only known now
+	addMaskedSecret(password)
+	return username, password, nil
+}
+
+// Disconnect logs out of the vCenter, unless the session is kept alive for the next collections
+func (vcenter *VCenter) Disconnect(ctx context.Context, client *govmomi.Client) {
+	if client == vcenter.client {
+		return
+	}
+	client.Logout(ctx)
+}
+
+// Close logs out of the cached vCenter session, if any
+func (vcenter *VCenter) Close() {
+	if vcenter.client == nil {
+		return
+	}
+	vcenter.client.Logout(context.Background())
+	vcenter.client = nil
+}
+
+// uniqueVCenters drops the vCenters configured more than once under different names, e.g. an alias and an IP
+// address, recognized by their instance UUID, so their inventory is not collected twice.
+// A vCenter in linked mode only exposes its own inventory through its API, so linked vCenters are collected
+// separately and their objects are always tagged with the vCenter owning them.
+func uniqueVCenters(vcenters []*VCenter) []*VCenter {
+	seen := make(map[string]string)
+	unique := []*VCenter{}
+	for _, vcenter := range vcenters {
+		if vcenter.instanceUUID != "" {
+			if hostname, ok := seen[vcenter.instanceUUID]; ok {
+				errlog.Println("Warning: vcenter ", vcenter.Hostname, " is the same instance as vcenter ", hostname, ", skipping it")
+				vcenter.Close()
+				continue
+			}
+			seen[vcenter.instanceUUID] = vcenter.Hostname
+		}
+		unique = append(unique, vcenter)
+	}
+	return unique
+}
+
 // Init the VCenter connection
 func (vcenter *VCenter) Init(config Configuration) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Retried at the next cycle until it succeeds
+	vcenter.initFailed = true
+
 	client, err := vcenter.Connect()
 	if err != nil {
 		errlog.Println("Could not connect to vcenter: ", vcenter.Hostname)
 		errlog.Println("Error: ", err)
 		return
 	}
-	defer client.Logout(ctx)
+	defer vcenter.Disconnect(ctx, client)
+	vcenter.checkClockSkew(config.MaxClockSkew)
+	vcenter.instanceUUID = client.ServiceContent.About.InstanceUuid
 
 	var perfmanager mo.PerformanceManager
 	err = client.RetrieveOne(ctx, *client.ServiceContent.PerfManager, nil, &perfmanager)
@@ -128,51 +594,329 @@ func (vcenter *VCenter) Init(config Configuration) {
 		errlog.Println("Error: ", err)
 		return
 	}
+	vcenter.initFailed = false
+
+	// Fingerprint the counter set to detect changes between initializations
+	counterHash := fnv.New64a()
+	for _, perf := range perfmanager.PerfCounter {
+		groupinfo := perf.GroupInfo.GetElementDescription()
+		nameinfo := perf.NameInfo.GetElementDescription()
+		fmt.Fprintf(counterHash, "%d=%s.%s.%s;", perf.Key, groupinfo.Key, nameinfo.Key, perf.RollupType)
+	}
+	if vcenter.counterHash != 0 && vcenter.counterHash != counterHash.Sum64() {
+		stdlog.Println("Performance counters changed on vcenter: ", vcenter.Hostname, ", refreshing metric keys")
+	}
+	vcenter.counterHash = counterHash.Sum64()
+
+	// The metrics of the vCenter override the global ones
+	metrics := config.Metrics
+	if len(vcenter.Metrics) > 0 {
+		metrics = vcenter.Metrics
+	}
+
+	// Counter groups excluded as a whole, accepted as "sys" or "sys.*"
+	excludedGroups := make(map[string]bool)
+	for _, group := range config.ExcludeGroups {
+		excludedGroups[strings.TrimSuffix(group, ".*")] = true
+	}
 
+	metricGroups := []*MetricGroup{}
+	matched := make(map[string]bool)
+	outOfLevel := make(map[string]int32)
+	inExcludedGroup := make(map[string]bool)
 	for _, perf := range perfmanager.PerfCounter {
 		groupinfo := perf.GroupInfo.GetElementDescription()
 		nameinfo := perf.NameInfo.GetElementDescription()
 		identifier := groupinfo.Key + "." + nameinfo.Key + "." + fmt.Sprint(perf.RollupType)
-		for _, metric := range config.Metrics {
+		if excludedGroups[groupinfo.Key] {
+			inExcludedGroup[identifier] = true
+			continue
+		}
+		// Skip the counters outside the configured statistics levels, the vCenter may not record them
+		if (config.MinCounterLevel > 0 && int(perf.Level) < config.MinCounterLevel) || (config.MaxCounterLevel > 0 && int(perf.Level) > config.MaxCounterLevel) {
+			outOfLevel[identifier] = perf.Level
+			continue
+		}
+		for _, metric := range metrics {
 			for _, metricdef := range metric.Definition {
 				if metricdef.Metric == identifier {
-					metricd := MetricDef{Metric: metricdef.Metric, Instances: metricdef.Instances, Key: perf.Key}
+					matched[identifier] = true
+					metricd := metricdef
+					metricd.Key = perf.Key
 					for _, mtype := range metric.ObjectType {
 						added := false
-						for _, metricgroup := range vcenter.MetricGroups {
+						for _, metricgroup := range metricGroups {
 							if metricgroup.ObjectType == mtype {
-								metricgroup.Metrics = append(metricgroup.Metrics, metricd)
+								// Each rollup is its own counter, but the same counter and instances must only be queried once
+								if !metricgroup.hasMetric(metricd) {
+									metricgroup.Metrics = append(metricgroup.Metrics, metricd)
+								}
 								added = true
 								break
 							}
 						}
 						if added == false {
 							metricgroup := MetricGroup{ObjectType: mtype, Metrics: []MetricDef{metricd}}
-							vcenter.MetricGroups = append(vcenter.MetricGroups, &metricgroup)
+							metricGroups = append(metricGroups, &metricgroup)
 						}
 					}
 				}
 			}
 		}
 	}
+	vcenter.MetricGroups = metricGroups
+
+	// Warn about the configured metrics that are not available
+	for _, metric := range metrics {
+		for _, metricdef := range metric.Definition {
+			if inExcludedGroup[metricdef.Metric] {
+				continue
+			}
+			if level, ok := outOfLevel[metricdef.Metric]; ok && !matched[metricdef.Metric] {
+				errlog.Println("Warning: metric ", metricdef.Metric, " is a level ", level, " counter outside the configured counter levels, skipping it on vcenter: ", vcenter.Hostname)
+			} else if !matched[metricdef.Metric] {
+				errlog.Println("Warning: metric ", metricdef.Metric, " matched no performance counter on vcenter: ", vcenter.Hostname)
+			}
+		}
+	}
+
+	// Rollups can only be reduced from the samples of the none or average rollup of their counter
+	if config.ShareRollups {
+		_, _, unsourced := vcenter.rollupSiblings()
+		for _, counter := range unsourced {
+			errlog.Println("Warning: ", counter, " has no none or average rollup to share its samples with the others, querying each of them on vcenter: ", vcenter.Hostname)
+		}
+	}
+}
+
+// sharedRollupSources are the rollups whose samples the other rollups of a counter can be reduced from, by
+// preference. The summation and latest rollups are never reduced from another one.
+var sharedRollupSources = []string{"none", "average"}
+
+// sharableRollups are the rollups reduced from the samples of a source rollup when sharing them
+var sharableRollups = map[string]bool{"none": true, "average": true, "maximum": true, "minimum": true}
+
+// rollupSiblings groups the rollups of a counter queried for the same instances. The none rollup, or else the
+// average one, of each group is queried, and the minimum, maximum and average rollups, which are returned as
+// shared, are reduced from its samples. It also returns the counters of the groups without such a source,
+// whose rollups are all queried.
+func (vcenter *VCenter) rollupSiblings() (map[metricKey][]int32, map[metricKey]bool, []string) {
+	siblings := make(map[metricKey][]int32)
+	shared := make(map[metricKey]bool)
+	unsourced := []string{}
+	for _, metricgroup := range vcenter.MetricGroups {
+		// Group the rollups by counter and instances, in the order they are configured
+		counters := []string{}
+		rollups := make(map[string][]MetricDef)
+		for _, metricdef := range metricgroup.Metrics {
+			counter := metricdef.Metric[:strings.LastIndex(metricdef.Metric, ".")+1] + metricdef.Instances
+			if _, ok := rollups[counter]; !ok {
+				counters = append(counters, counter)
+			}
+			rollups[counter] = append(rollups[counter], metricdef)
+		}
+
+		for _, counter := range counters {
+			if len(rollups[counter]) < 2 {
+				continue
+			}
+			var source *MetricDef
+			for _, rollup := range sharedRollupSources {
+				for i, metricdef := range rollups[counter] {
+					if source == nil && rollupOf(metricdef.Metric) == rollup {
+						source = &rollups[counter][i]
+					}
+				}
+			}
+			if source == nil {
+				unsourced = append(unsourced, metricgroup.ObjectType+" "+strings.TrimSuffix(counter, "."))
+				continue
+			}
+			primary := metricKey{ObjectType: metricgroup.ObjectType, Key: source.Key}
+			for _, metricdef := range rollups[counter] {
+				if metricdef.Key == source.Key || !sharableRollups[rollupOf(metricdef.Metric)] {
+					continue
+				}
+				siblings[primary] = append(siblings[primary], metricdef.Key)
+				shared[metricKey{ObjectType: metricgroup.ObjectType, Key: metricdef.Key}] = true
+			}
+		}
+	}
+	return siblings, shared, unsourced
+}
+
+// rollupOf returns the rollup of a metric name, e.g. average for cpu.usage.average
+func rollupOf(metric string) string {
+	return metric[strings.LastIndex(metric, ".")+1:]
+}
+
+// shareRollups adds a copy of the queried series for each of the rollups reduced from their samples
+func shareRollups(series []types.BasePerfMetricSeries, objectType string, siblings map[metricKey][]int32) []types.BasePerfMetricSeries {
+	shared := []types.BasePerfMetricSeries{}
+	for _, baseserie := range series {
+		serie, ok := baseserie.(*types.PerfMetricIntSeries)
+		if !ok {
+			continue
+		}
+		for _, key := range siblings[metricKey{ObjectType: objectType, Key: serie.Id.CounterId}] {
+			sibling := *serie
+			sibling.Id.CounterId = key
+			// Each sibling gets its own samples so the series never share a backing array
+			sibling.Value = append([]int64(nil), serie.Value...)
+			shared = append(shared, &sibling)
+		}
+	}
+	return append(series, shared...)
+}
+
+// vmSummaryProperties are the VM summary properties in use, retrieved instead of the whole summary to keep the
+// payload small on large inventories
+var vmSummaryProperties = []string{
+	"summary.config",
+	"summary.runtime.host",
+	"summary.runtime.connectionState",
+	"summary.runtime.powerState",
+	"summary.runtime.bootTime",
+	"summary.quickStats.guestHeartbeatStatus",
+	"summary.quickStats.balloonedMemory",
+	"summary.quickStats.swappedMemory",
+	"summary.quickStats.compressedMemory",
+	"summary.quickStats.overallCpuUsage",
+	"summary.quickStats.overallCpuDemand",
+	"summary.quickStats.guestMemoryUsage",
+	"summary.quickStats.hostMemoryUsage",
+	"summary.quickStats.distributedCpuEntitlement",
+	"summary.quickStats.distributedMemoryEntitlement",
+	"summary.quickStats.staticCpuEntitlement",
+	"summary.quickStats.staticMemoryEntitlement",
+	"summary.overallStatus",
+}
+
+// metricDefinitions maps the counters to their metric definitions per object type, as each type has its own
+// definitions of a counter
+func metricDefinitions(groups []*MetricGroup) map[metricKey]MetricDef {
+	metricDefs := make(map[metricKey]MetricDef)
+	for _, metricgroup := range groups {
+		for _, metricdef := range metricgroup.Metrics {
+			metricDefs[metricKey{ObjectType: metricgroup.ObjectType, Key: metricdef.Key}] = metricdef
+		}
+	}
+	return metricDefs
+}
+
+// vCenterTags returns the tags identifying the vCenter a point comes from
+func (config Configuration) vCenterTags(vcName string) map[string]string {
+	key := config.VCenterTagKey
+	if key == "" {
+		key = "host"
+	}
+	tags := map[string]string{key: vcName}
+	// Keep the historical host tag for existing dashboards
+	if config.LegacyHostTag {
+		tags["host"] = vcName
+	}
+	return tags
+}
+
+// measurementName returns the measurement configured for an object type, or the given default
+func (config Configuration) measurementName(objectType string, defaultName string) string {
+	if name, ok := config.MeasurementNames[objectType]; ok && name != "" {
+		return name
+	}
+	return defaultName
+}
+
+// esxTagKey returns the tag key holding the ESXi host of a VM
+func (config Configuration) esxTagKey() string {
+	if config.EsxTagKey == "" {
+		return "esx"
+	}
+	return config.EsxTagKey
+}
+
+// vmHostName returns the name of the host of a VM, empty when it has no host or the host is unknown
+func vmHostName(vm mo.VirtualMachine, hostSummary map[types.ManagedObjectReference]map[string]string) string {
+	if vm.Summary.Runtime.Host == nil {
+		return ""
+	}
+	return hostSummary[*vm.Summary.Runtime.Host]["name"]
+}
+
+// taggedObjects returns the objects bearing a vSphere tag. They are resolved again every RefreshCycles cycles only,
+// as each lookup logs in to the REST API and lists the tag associations.
+func (vcenter *VCenter) taggedObjects(filter TagFilter) (map[types.ManagedObjectReference]bool, error) {
+	refreshCycles := filter.RefreshCycles
+	if refreshCycles <= 0 {
+		refreshCycles = 10
+	}
+	if vcenter.tagged != nil && vcenter.cycle-vcenter.taggedCycle < refreshCycles {
+		return vcenter.tagged, nil
+	}
+	rest, err := NewRestClient(vcenter)
+	if err != nil {
+		return nil, err
+	}
+	defer rest.Logout()
+	tagged, err := rest.TaggedObjects(filter.Category, filter.Name)
+	if err != nil {
+		return nil, err
+	}
+	vcenter.tagged = tagged
+	vcenter.taggedCycle = vcenter.cycle
+	return tagged, nil
 }
 
-// Query a vcenter
-func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.Client) {
+// collectType tells if an object type is due for collection in the current cycle
+func (vcenter *VCenter) collectType(config Configuration, objectType string) bool {
+	multiplier := config.IntervalMultipliers[objectType]
+	return multiplier <= 1 || vcenter.cycle%multiplier == 0
+}
+
+// Query a vcenter, returning an error when the collection failed before its points could be written
+func (vcenter *VCenter) Query(config Configuration, output Output) error {
 	stdlog.Println("Setting up query inventory of vcenter: ", vcenter.Hostname)
 
 	// Create the contect
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	vcName := config.stripName(vcenter.Hostname)
+	cycleTime := config.cycleTime()
+
+	// Count the errors of this cycle per stage, they are sent even when the collection fails
+	scrapeErrors := map[string]int64{"connect": 0, "retrieve": 0, "queryperf": 0, "write": 0, "empty": 0, "fault": 0}
+	defer writeScrapeErrors(vcName, config, output, scrapeErrors)
+
+	// Report the status of the cycle, whether it succeeds or not
+	status := NewCollectorStatus()
+	defer writeCollectorStatus(vcName, config, output, status)
+
 	// Get the client
 	client, err := vcenter.Connect()
 	if err != nil {
 		errlog.Println("Could not connect to vcenter: ", vcenter.Hostname)
 		errlog.Println("Error: ", err)
-		return
+		scrapeErrors["connect"]++
+		return err
+	}
+	defer vcenter.Disconnect(ctx, client)
+	vcenter.checkClockSkew(config.MaxClockSkew)
+	status.ClockSkew = vcenter.clockSkew
+
+	// Count the sessions of the collector's user, unless the account was refused access to the session list
+	if !vcenter.sessionsDenied {
+		sessions, err := userSessions(ctx, client)
+		if isNoPermission(err) {
+			errlog.Println("Warning: the account has no permission to list the sessions of vcenter: ", vcenter.Hostname, ", they are no longer counted")
+			vcenter.sessionsDenied = true
+		} else if err != nil {
+			errlog.Println("Could not retrieve sessions from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		} else {
+			status.Sessions = sessions
+		}
 	}
-	defer client.Logout(ctx)
 
 	// Create the view manager
 	var viewManager mo.ViewManager
@@ -180,7 +924,8 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 	if err != nil {
 		errlog.Println("Could not get view manager from vcenter: " + vcenter.Hostname)
 		errlog.Println("Error: ", err)
-		return
+		scrapeErrors["retrieve"]++
+		return err
 	}
 
 	// Get the Datacenters from root folder
@@ -189,7 +934,8 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 	if err != nil {
 		errlog.Println("Could not get root folder from vcenter: " + vcenter.Hostname)
 		errlog.Println("Error: ", err)
-		return
+		scrapeErrors["retrieve"]++
+		return err
 	}
 
 	datacenters := []types.ManagedObjectReference{}
@@ -205,28 +951,69 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 	}
 	objectTypes = append(objectTypes, "ClusterComputeResource")
 	objectTypes = append(objectTypes, "ResourcePool")
+	objectTypes = append(objectTypes, "StoragePod")
+	if config.Collect.Network {
+		objectTypes = append(objectTypes, "DistributedVirtualPortgroup")
+	}
+	if config.Collect.DatastoreCapacity {
+		objectTypes = append(objectTypes, "Datastore")
+	}
+	objectTypes = unique(objectTypes)
+	if !config.Collect.resourcePools() {
+		for i, objectType := range objectTypes {
+			if objectType == "ResourcePool" {
+				objectTypes = append(objectTypes[:i], objectTypes[i+1:]...)
+				break
+			}
+		}
+	}
 
-	// Loop trought datacenters and create the intersting object reference list
+	// Loop trought datacenters and create the intersting object reference list.
+	// Each datacenter gets its own view, so up to MaxConcurrentViews of them are created concurrently.
+	maxViews := config.MaxConcurrentViews
+	if maxViews <= 0 {
+		maxViews = 4
+	}
+	views := make([][]types.ManagedObjectReference, len(datacenters))
+	viewSlots := make(chan struct{}, maxViews)
+	var viewErrors sync.Mutex
+	var viewsDone sync.WaitGroup
+	for i, datacenter := range datacenters {
+		viewsDone.Add(1)
+		viewSlots <- struct{}{}
+		go func(i int, datacenter types.ManagedObjectReference) {
+			defer viewsDone.Done()
+			defer func() { <-viewSlots }()
+			// Create the CreateContentView request
+			req := types.CreateContainerView{This: viewManager.Reference(), Container: datacenter, Type: objectTypes, Recursive: true}
+			res, err := methods.CreateContainerView(ctx, client.RoundTripper, &req)
+			if err != nil {
+				errlog.Println("Could not create container view from vcenter: " + vcenter.Hostname)
+				errlog.Println("Error: ", err)
+				viewErrors.Lock()
+				scrapeErrors["retrieve"]++
+				viewErrors.Unlock()
+				return
+			}
+			// Retrieve the created ContentView
+			var containerView mo.ContainerView
+			err = client.RetrieveOne(ctx, res.Returnval, nil, &containerView)
+			if err != nil {
+				errlog.Println("Could not get container view from vcenter: " + vcenter.Hostname)
+				errlog.Println("Error: ", err)
+				viewErrors.Lock()
+				scrapeErrors["retrieve"]++
+				viewErrors.Unlock()
+				return
+			}
+			views[i] = containerView.View
+		}(i, datacenter)
+	}
+	viewsDone.Wait()
+	// Add found object to object list, in the order of the datacenters
 	mors := []types.ManagedObjectReference{}
-	for _, datacenter := range datacenters {
-		// Create the CreateContentView request
-		req := types.CreateContainerView{This: viewManager.Reference(), Container: datacenter, Type: objectTypes, Recursive: true}
-		res, err := methods.CreateContainerView(ctx, client.RoundTripper, &req)
-		if err != nil {
-			errlog.Println("Could not create container view from vcenter: " + vcenter.Hostname)
-			errlog.Println("Error: ", err)
-			continue
-		}
-		// Retrieve the created ContentView
-		var containerView mo.ContainerView
-		err = client.RetrieveOne(ctx, res.Returnval, nil, &containerView)
-		if err != nil {
-			errlog.Println("Could not get container view from vcenter: " + vcenter.Hostname)
-			errlog.Println("Error: ", err)
-			continue
-		}
-		// Add found object to object list
-		mors = append(mors, containerView.View...)
+	for _, view := range views {
+		mors = append(mors, view...)
 	}
 
 	// Create MORS for each object type
@@ -234,6 +1021,9 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 	hostRefs := []types.ManagedObjectReference{}
 	clusterRefs := []types.ManagedObjectReference{}
 	respoolRefs := []types.ManagedObjectReference{}
+	portgroupRefs := []types.ManagedObjectReference{}
+	podRefs := []types.ManagedObjectReference{}
+	datastoreRefs := []types.ManagedObjectReference{}
 
 	newMors := []types.ManagedObjectReference{}
 
@@ -250,70 +1040,163 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 			clusterRefs = append(clusterRefs, mor)
 		} else if mor.Type == "ResourcePool" {
 			respoolRefs = append(respoolRefs, mor)
+		} else if mor.Type == "DistributedVirtualPortgroup" {
+			portgroupRefs = append(portgroupRefs, mor)
+		} else if mor.Type == "StoragePod" {
+			podRefs = append(podRefs, mor)
+		} else if mor.Type == "Datastore" {
+			datastoreRefs = append(datastoreRefs, mor)
 		}
 	}
 	// Copy the mors without the clusters
 	mors = newMors
 
+	// Only collect the entities bearing the filter tag, collecting everything if tagging is unavailable.
+	// The summaries of every host are still retrieved to tag the collected VMs with their host.
+	allHostRefs := hostRefs
+	if config.TagFilter.Name != "" {
+		tagged, err := vcenter.taggedObjects(config.TagFilter)
+		if err != nil {
+			errlog.Println("Could not resolve tag filter on vcenter: ", vcenter.Hostname, ", collecting all entities")
+			errlog.Println("Error: ", err)
+		} else {
+			vmRefs = filterRefs(vmRefs, tagged)
+			hostRefs = filterRefs(hostRefs, tagged)
+			mors = filterRefs(mors, tagged)
+		}
+	}
+
+	// Cap the number of entities per type to evaluate the configuration against large vCenters
+	if config.MaxEntitiesPerType > 0 {
+		vmRefs = limitRefs(vmRefs, config.MaxEntitiesPerType)
+		hostRefs = limitRefs(hostRefs, config.MaxEntitiesPerType)
+		clusterRefs = limitRefs(clusterRefs, config.MaxEntitiesPerType)
+		respoolRefs = limitRefs(respoolRefs, config.MaxEntitiesPerType)
+		portgroupRefs = limitRefs(portgroupRefs, config.MaxEntitiesPerType)
+		podRefs = limitRefs(podRefs, config.MaxEntitiesPerType)
+		datastoreRefs = limitRefs(datastoreRefs, config.MaxEntitiesPerType)
+		mors = append(append([]types.ManagedObjectReference{}, vmRefs...), hostRefs...)
+	}
+
+	status.Entities["VirtualMachine"] = len(vmRefs)
+	status.Entities["HostSystem"] = len(hostRefs)
+	status.Entities["ClusterComputeResource"] = len(clusterRefs)
+	status.Entities["ResourcePool"] = len(respoolRefs)
+	status.Entities["DistributedVirtualPortgroup"] = len(portgroupRefs)
+	status.Entities["Datastore"] = len(datastoreRefs)
+	status.Entities["StoragePod"] = len(podRefs)
+
 	pc := property.DefaultCollector(client.Client)
+	timings := NewRPCTimings()
 
 	// Retrieve properties for all vms
+	vmProperties := append([]string{}, vmSummaryProperties...)
+	if config.GuestTags {
+		vmProperties = append(vmProperties, "guest")
+	}
+	if config.Collect.VirtualDisks {
+		vmProperties = append(vmProperties, "config.hardware.device")
+	}
+	if config.Collect.VmTuning {
+		vmProperties = append(vmProperties, "config.latencySensitivity", "config.cpuAffinity")
+	}
+	// The capabilities rarely change, so they can be collected less often than the other VM fields
+	vmCapabilities := config.Collect.VmCapabilities && vcenter.collectType(config, "VmCapabilities")
+	if vmCapabilities {
+		vmProperties = append(vmProperties, "config.cpuHotAddEnabled", "config.memoryHotAddEnabled", "config.version")
+	}
 	var vmmo []mo.VirtualMachine
-	err = pc.Retrieve(ctx, vmRefs, []string{"summary"}, &vmmo)
+	rpcStart := time.Now()
+	faulted, err := vcenter.retrieveProperties(ctx, pc, vmRefs, vmProperties, &vmmo, config.PropertyFaults)
+	scrapeErrors["fault"] += int64(faulted)
+	timings.Track("VirtualMachine", rpcStart)
 	if err != nil {
 		fmt.Println(err)
-		return
+		scrapeErrors["retrieve"]++
+		return err
 	}
 
 	// Retrieve properties for hosts
+	hostProperties := []string{
+		"summary.config.name",
+		"summary.hardware.numCpuThreads",
+		"summary.quickStats.overallCpuUsage",
+		"summary.quickStats.overallMemoryUsage",
+		"summary.quickStats.distributedCpuFairness",
+		"summary.quickStats.distributedMemoryFairness",
+		"summary.overallStatus",
+	}
+	if config.Collect.HostServices {
+		hostProperties = append(hostProperties, "config.service", "config.firewall")
+	}
+	if config.Collect.HostTime {
+		hostProperties = append(hostProperties, "config.dateTimeInfo")
+		if !config.Collect.HostServices {
+			hostProperties = append(hostProperties, "config.service")
+		}
+	}
+	if config.Collect.Numa {
+		hostProperties = append(hostProperties, "hardware.numaInfo")
+	}
+	if config.Collect.HostHardware {
+		hostProperties = append(hostProperties, "summary.hardware.vendor", "summary.hardware.model", "summary.hardware.otherIdentifyingInfo", "hardware.biosInfo")
+	}
+	if config.Collect.HostBuild {
+		hostProperties = append(hostProperties, "summary.config.product")
+	}
+	if config.DatastoreFallback {
+		hostProperties = append(hostProperties, "datastore")
+	}
 	var hsmo []mo.HostSystem
-	err = pc.Retrieve(ctx, hostRefs, []string{"summary"}, &hsmo)
+	rpcStart = time.Now()
+	faulted, err = vcenter.retrieveProperties(ctx, pc, allHostRefs, hostProperties, &hsmo, config.PropertyFaults)
+	scrapeErrors["fault"] += int64(faulted)
+	timings.Track("HostSystem", rpcStart)
 	if err != nil {
 		fmt.Println(err)
-		return
+		scrapeErrors["retrieve"]++
+		return err
 	}
+	collectedHosts := selectHosts(hsmo, hostRefs)
 
 	//Retrieve properties for ResourcePool
 	var rpmo []mo.ResourcePool
-	err = pc.Retrieve(ctx, respoolRefs, []string{"summary"}, &rpmo)
-	if err != nil {
-		fmt.Println(err)
-		return
+	if len(respoolRefs) > 0 {
+		rpcStart = time.Now()
+		faulted, err = vcenter.retrieveProperties(ctx, pc, respoolRefs, []string{"summary", "vm"}, &rpmo, config.PropertyFaults)
+		scrapeErrors["fault"] += int64(faulted)
+		timings.Track("ResourcePool", rpcStart)
+		if err != nil {
+			fmt.Println(err)
+			scrapeErrors["retrieve"]++
+			return err
+		}
 	}
 
 	// Initialize the map that will hold the VM MOR to ResourcePool reference
 	vmToPool := make(map[types.ManagedObjectReference]string)
 
-	// Retrieve properties for ResourcePools
-	if len(respoolRefs) > 0 {
+	// Map the VMs to their ResourcePool
+	for _, pool := range rpmo {
+		summary := pool.Summary.GetResourcePoolSummary()
 		if debug == true {
-			stdlog.Println("going inside ResourcePools")
-		}
-		var respool []mo.ResourcePool
-		err = pc.Retrieve(ctx, respoolRefs, []string{"name", "config", "vm"}, &respool)
-		if err != nil {
-			fmt.Println(err)
-			return
+			stdlog.Println("---resourcepool name - you should see every resourcepool here (+VMs inside)----")
+			stdlog.Println(summary.Name)
 		}
-		for _, pool := range respool {
-			stdlog.Println(pool.Config.MemoryAllocation.GetResourceAllocationInfo().Limit)
-			stdlog.Println(pool.Config.CpuAllocation.GetResourceAllocationInfo().Limit)
+		for _, vm := range pool.Vm {
 			if debug == true {
-				stdlog.Println("---resourcepool name - you should see every resourcepool here (+VMs inside)----")
-				stdlog.Println(pool.Name)
-			}
-			for _, vm := range pool.Vm {
-				if debug == true {
-					stdlog.Println("--VM ID - you should see every VM ID here--")
-					stdlog.Println(vm)
-				}
-				vmToPool[vm] = pool.Name
+				stdlog.Println("--VM ID - you should see every VM ID here--")
+				stdlog.Println(vm)
 			}
+			vmToPool[vm] = summary.Name
 		}
 	}
 
 	// Initialize the map that will hold the VM MOR to cluster reference
 	vmToCluster := make(map[types.ManagedObjectReference]string)
+	hostToCluster := make(map[types.ManagedObjectReference]string)
+	clusterNames := make(map[types.ManagedObjectReference]string)
+	clusterMetrics := make(map[types.ManagedObjectReference]map[string]interface{})
 
 	// Retrieve properties for clusters, if any
 	if len(clusterRefs) > 0 {
@@ -321,10 +1204,14 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 			stdlog.Println("going inside clusters")
 		}
 		var clmo []mo.ClusterComputeResource
-		err = pc.Retrieve(ctx, clusterRefs, []string{"name", "configuration"}, &clmo)
+		rpcStart = time.Now()
+		faulted, err = vcenter.retrieveProperties(ctx, pc, clusterRefs, []string{"name", "configuration", "summary", "host"}, &clmo, config.PropertyFaults)
+		scrapeErrors["fault"] += int64(faulted)
+		timings.Track("ClusterComputeResource", rpcStart)
 		if err != nil {
 			fmt.Println(err)
-			return
+			scrapeErrors["retrieve"]++
+			return err
 		}
 		for _, cl := range clmo {
 			if debug == true {
@@ -344,7 +1231,195 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 
 				vmToCluster[vm.Key] = cl.Name
 			}
+
+			for _, host := range cl.Host {
+				hostToCluster[host] = cl.Name
+			}
+
+			// DRS and HA status of the cluster
+			clusterNames[cl.Self] = cl.Name
+			clusterMetrics[cl.Self] = map[string]interface{}{
+				"drs_enabled":               boolValue(cl.Configuration.DrsConfig.Enabled),
+				"drs_behavior":              drsBehaviors[cl.Configuration.DrsConfig.DefaultVmBehavior],
+				"ha_enabled":                boolValue(cl.Configuration.DasConfig.Enabled),
+				"admission_control_enabled": boolValue(cl.Configuration.DasConfig.AdmissionControlEnabled),
+				"failover_level":            int64(cl.Configuration.DasConfig.FailoverLevel),
+			}
+			if summary, ok := cl.Summary.(*types.ClusterComputeResourceSummary); ok {
+				clusterMetrics[cl.Self]["current_failover_level"] = int64(summary.CurrentFailoverLevel)
+				clusterMetrics[cl.Self]["total_cpu"] = int64(summary.TotalCpu)
+				clusterMetrics[cl.Self]["total_memory"] = summary.TotalMemory
+				clusterMetrics[cl.Self]["effective_cpu"] = int64(summary.EffectiveCpu)
+				clusterMetrics[cl.Self]["effective_memory"] = summary.EffectiveMemory
+				// Usage is summarized from vSphere 6.0
+				if usage := summary.UsageSummary; usage != nil {
+					clusterMetrics[cl.Self]["cpu_usage_percent"] = percent(int64(usage.CpuDemandMhz), int64(usage.TotalCpuCapacityMhz))
+					clusterMetrics[cl.Self]["memory_usage_percent"] = percent(int64(usage.MemDemandMB), int64(usage.TotalMemCapacityMB))
+				}
+			}
+		}
+	}
+
+	// Points built from inventory properties rather than performance counters
+	inventoryPoints := []*influxclient.Point{}
+	// Inventory points of an object type, written in the priority tier of their type
+	entityPoints := make(map[string][]*influxclient.Point)
+
+	// Retrieve the port usage of distributed portgroups
+	if len(portgroupRefs) > 0 {
+		rpcStart = time.Now()
+		points, err := portgroupPoints(ctx, client, pc, portgroupRefs, config.vCenterTags(vcName))
+		timings.Track("DistributedVirtualPortgroup", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve distributed portgroups from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		}
+		entityPoints["DistributedVirtualPortgroup"] = append(entityPoints["DistributedVirtualPortgroup"], points...)
+	}
+
+	// Retrieve the datastore clusters and map their member datastores to them
+	datastoreToCluster := make(map[string]string)
+	if len(podRefs) > 0 {
+		rpcStart = time.Now()
+		points, datastoreClusters, err := storagePodPoints(ctx, pc, podRefs, config.vCenterTags(vcName))
+		timings.Track("StoragePod", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve datastore clusters from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		} else {
+			datastoreToCluster = datastoreClusters
+		}
+		if vcenter.collectType(config, "StoragePod") {
+			entityPoints["StoragePod"] = append(entityPoints["StoragePod"], points...)
+		}
+	}
+
+	// Retrieve the capacity of the datastores
+	if config.Collect.DatastoreCapacity && len(datastoreRefs) > 0 && vcenter.collectType(config, "Datastore") {
+		rpcStart = time.Now()
+		points, err := datastoreCapacityPoints(ctx, pc, datastoreRefs, config, config.vCenterTags(vcName))
+		timings.Track("Datastore", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve datastores from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		}
+		entityPoints["Datastore"] = append(entityPoints["Datastore"], points...)
+	}
+
+	// Add the virtual disks of the VMs, retrieved with their properties
+	if config.Collect.VirtualDisks {
+		entityPoints["VirtualMachine"] = append(entityPoints["VirtualMachine"], vdiskPoints(vmmo, config, config.vCenterTags(vcName))...)
+	}
+
+	// Add the NUMA nodes of the hosts, retrieved with their properties
+	if config.Collect.Numa {
+		entityPoints["HostSystem"] = append(entityPoints["HostSystem"], numaPoints(collectedHosts, config, config.vCenterTags(vcName))...)
+	}
+
+	// Add the ESXi builds of the hosts, which only change when patching
+	if config.Collect.HostBuild && vcenter.collectType(config, "HostBuild") {
+		entityPoints["HostSystem"] = append(entityPoints["HostSystem"], hostBuildPoints(collectedHosts, config, config.vCenterTags(vcName))...)
+	}
+
+	// Retrieve the vSAN capacity of the clusters
+	if config.Collect.Vsan && len(clusterRefs) > 0 && vcenter.collectType(config, "Vsan") {
+		rpcStart = time.Now()
+		points, err := vsanPoints(ctx, client.Client, pc, clusterRefs, config.vCenterTags(vcName))
+		timings.Track("Vsan", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve vSAN clusters from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		}
+		entityPoints["ClusterComputeResource"] = append(entityPoints["ClusterComputeResource"], points...)
+	}
+
+	// Retrieve the content libraries through the REST API
+	if config.Collect.ContentLibrary && vcenter.collectType(config, "ContentLibrary") {
+		rpcStart = time.Now()
+		points, err := contentLibraryPoints(vcenter, config.vCenterTags(vcName))
+		timings.Track("ContentLibrary", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve content libraries from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		}
+		inventoryPoints = append(inventoryPoints, points...)
+	}
+
+	// Retrieve the triggered alarms, which the root folder reports for the whole inventory
+	if config.Collect.Alarms && vcenter.collectType(config, "Alarm") {
+		rpcStart = time.Now()
+		points, err := alarmPoints(ctx, pc, rootFolder.TriggeredAlarmState, config, config.vCenterTags(vcName))
+		timings.Track("Alarm", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve alarms from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		}
+		inventoryPoints = append(inventoryPoints, points...)
+	}
+
+	// Count the VM migrations since the events read by the previous cycle
+	if config.Collect.Vmotion && vcenter.collectType(config, "Vmotion") {
+		end := time.Now()
+		begin := vcenter.lastEvents
+		if begin.IsZero() {
+			// Without a previous read, look back one interval, or one minute for single runs
+			begin = end.Add(-time.Minute)
+			if config.Interval > 0 {
+				begin = end.Add(-time.Duration(config.Interval) * time.Second)
+			}
+		}
+		rpcStart = time.Now()
+		events, err := migrationEvents(ctx, client.Client, begin, end)
+		timings.Track("Vmotion", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve migration events from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		} else {
+			vcenter.lastEvents = end
+			inventoryPoints = append(inventoryPoints, vmotionPoints(events, config, config.vCenterTags(vcName), end)...)
+		}
+	}
+
+	// Write the state changes of the VMs and hosts since the previous cycle, to annotate the graphs
+	if config.Collect.Events && vcenter.collectType(config, "Events") {
+		begin, end := eventWindow(vcenter.lastStateEvents, config.Interval)
+		rpcStart = time.Now()
+		events, err := readEvents(ctx, client.Client, begin, end, stateEventTypes)
+		timings.Track("Events", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve events from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		} else {
+			vcenter.lastStateEvents = end
+			points, lastKey := eventPoints(events, vcenter.lastEventKey, config, config.vCenterTags(vcName))
+			vcenter.lastEventKey = lastKey
+			inventoryPoints = append(inventoryPoints, points...)
+		}
+	}
+
+	// Retrieve the license usage, unless the account was refused access to the license manager
+	licenseManager := client.ServiceContent.LicenseManager
+	if config.Collect.License && licenseManager != nil && !vcenter.licenseDenied && vcenter.collectType(config, "License") {
+		rpcStart = time.Now()
+		points, err := licensePoints(ctx, pc, *licenseManager, config.vCenterTags(vcName))
+		timings.Track("License", rpcStart)
+		if isNoPermission(err) {
+			errlog.Println("Warning: the account has no permission to read the licenses of vcenter: ", vcenter.Hostname, ", they are no longer collected")
+			vcenter.licenseDenied = true
+		} else if err != nil {
+			errlog.Println("Could not retrieve licenses from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
 		}
+		inventoryPoints = append(inventoryPoints, points...)
 	}
 
 	// Retrieve properties for the pools
@@ -361,264 +1436,1542 @@ func (vcenter *VCenter) Query(config Configuration, InfluxDBClient influxclient.
 	for _, host := range hsmo {
 		hostSummary[host.Self] = make(map[string]string)
 		hostSummary[host.Self]["name"] = host.Summary.Config.Name
+		if cluster, ok := hostToCluster[host.Self]; ok {
+			hostSummary[host.Self]["cluster"] = cluster
+		}
+		if config.Collect.HostHardware {
+			addHostHardwareTags(hostSummary[host.Self], host)
+		}
 		hostExtraMetrics[host.Self] = make(map[string]int64)
 		hostExtraMetrics[host.Self]["cpu_corecount_total"] = int64(host.Summary.Hardware.NumCpuThreads)
+		// Instantaneous usage from the host quickStats
+		hostExtraMetrics[host.Self]["overall_cpu_usage"] = int64(host.Summary.QuickStats.OverallCpuUsage)
+		hostExtraMetrics[host.Self]["overall_memory_usage"] = int64(host.Summary.QuickStats.OverallMemoryUsage)
+		hostExtraMetrics[host.Self]["distributed_cpu_fairness"] = int64(host.Summary.QuickStats.DistributedCpuFairness)
+		hostExtraMetrics[host.Self]["distributed_memory_fairness"] = int64(host.Summary.QuickStats.DistributedMemoryFairness)
+		// Roll up the health of the host in a single coded field
+		if status, ok := overallStatuses[host.Summary.OverallStatus]; ok {
+			hostExtraMetrics[host.Self]["overall_status"] = status
+		}
+		for _, field := range vmConnectionStateFields {
+			hostExtraMetrics[host.Self][field] = 0
+		}
+		hostExtraMetrics[host.Self]["vm_count"] = 0
+		hostExtraMetrics[host.Self]["vcpu_count"] = 0
+		if config.Collect.HostServices {
+			addHostServicesMetrics(hostExtraMetrics[host.Self], host, config)
+		}
+		if config.Collect.HostTime {
+			addHostTimeMetrics(hostExtraMetrics[host.Self], host)
+		}
 	}
 
 	// Initialize the map that will hold all extra tags
 	vmSummary := make(map[types.ManagedObjectReference]map[string]string)
+	vmExtraMetrics := make(map[types.ManagedObjectReference]map[string]int64)
 
 	// Assign extra details per VM in vmSummary
 	for _, vm := range vmmo {
 		vmSummary[vm.Self] = make(map[string]string)
+		// Instantaneous memory pressure from the VM quickStats
+		vmExtraMetrics[vm.Self] = make(map[string]int64)
+		vmExtraMetrics[vm.Self]["ballooned_memory"] = int64(vm.Summary.QuickStats.BalloonedMemory)
+		vmExtraMetrics[vm.Self]["swapped_memory"] = int64(vm.Summary.QuickStats.SwappedMemory)
+		vmExtraMetrics[vm.Self]["compressed_memory"] = vm.Summary.QuickStats.CompressedMemory
+		// Instantaneous usage, independent of the windowed perf counters
+		vmExtraMetrics[vm.Self]["overall_cpu_usage"] = int64(vm.Summary.QuickStats.OverallCpuUsage)
+		// Entitlements computed by the scheduler, to compare with the demand and the consumption
+		vmExtraMetrics[vm.Self]["cpu_demand"] = int64(vm.Summary.QuickStats.OverallCpuDemand)
+		vmExtraMetrics[vm.Self]["guest_memory_usage"] = int64(vm.Summary.QuickStats.GuestMemoryUsage)
+		vmExtraMetrics[vm.Self]["host_memory_usage"] = int64(vm.Summary.QuickStats.HostMemoryUsage)
+		vmExtraMetrics[vm.Self]["cpu_entitlement"] = int64(vm.Summary.QuickStats.DistributedCpuEntitlement)
+		vmExtraMetrics[vm.Self]["memory_entitlement"] = int64(vm.Summary.QuickStats.DistributedMemoryEntitlement)
+		vmExtraMetrics[vm.Self]["static_cpu_entitlement"] = int64(vm.Summary.QuickStats.StaticCpuEntitlement)
+		vmExtraMetrics[vm.Self]["static_memory_entitlement"] = int64(vm.Summary.QuickStats.StaticMemoryEntitlement)
+		if status, ok := overallStatuses[vm.Summary.OverallStatus]; ok {
+			vmExtraMetrics[vm.Self]["overall_status"] = status
+		}
+		// Guest liveness reported by the Tools, and the boot time to spot unexpected reboots
+		if status, ok := overallStatuses[vm.Summary.QuickStats.GuestHeartbeatStatus]; ok {
+			vmExtraMetrics[vm.Self]["heartbeat_status"] = status
+		}
+		if vm.Summary.Runtime.BootTime != nil {
+			vmExtraMetrics[vm.Self]["boot_time"] = vm.Summary.Runtime.BootTime.Unix()
+		}
+		if config.Collect.VmTuning && vm.Config != nil {
+			addVMTuningMetrics(vmExtraMetrics[vm.Self], vm.Config)
+		}
+		if vmCapabilities && vm.Config != nil {
+			addVMCapabilitiesMetrics(vmExtraMetrics[vm.Self], vm.Config)
+		}
 		// Ugly way to extract datastore value
 		re, err := regexp.Compile(`\[(.*?)\]`)
 		if err != nil {
 			fmt.Println(err)
 		}
 		vmSummary[vm.Self]["datastore"] = strings.Replace(strings.Replace(re.FindString(fmt.Sprintln(vm.Summary.Config)), "[", "", -1), "]", "", -1)
+		if datastoreToCluster[vmSummary[vm.Self]["datastore"]] != "" {
+			vmSummary[vm.Self]["datastore_cluster"] = datastoreToCluster[vmSummary[vm.Self]["datastore"]]
+		}
 		if vmToCluster[vm.Self] != "" {
 			vmSummary[vm.Self]["cluster"] = vmToCluster[vm.Self]
 		}
 		if vmToPool[vm.Self] != "" {
 			vmSummary[vm.Self]["respool"] = vmToPool[vm.Self]
 		}
-		vmSummary[vm.Self]["esx"] = hostSummary[*vm.Summary.Runtime.Host]["name"]
+		// VMs without Tools do not report guest information
+		if config.GuestTags && vm.Guest != nil {
+			if vm.Guest.HostName != "" {
+				vmSummary[vm.Self]["guest_hostname"] = vm.Guest.HostName
+			}
+			if vm.Guest.IpAddress != "" {
+				vmSummary[vm.Self]["guest_ip"] = vm.Guest.IpAddress
+			}
+		}
+		// VMs being created or orphaned may have no host, or one that is not retrieved
+		if esx := vmHostName(vm, hostSummary); esx != "" {
+			vmSummary[vm.Self][config.esxTagKey()] = esx
+		} else if config.UnknownEsxTag != "" {
+			vmSummary[vm.Self][config.esxTagKey()] = config.UnknownEsxTag
+		}
+		if vm.Summary.Runtime.Host != nil {
+			// Count the VMs of the host per connection state to surface orphaned and inaccessible ones
+			if field, ok := vmConnectionStateFields[vm.Summary.Runtime.ConnectionState]; ok && hostExtraMetrics[*vm.Summary.Runtime.Host] != nil {
+				hostExtraMetrics[*vm.Summary.Runtime.Host][field]++
+			}
+			// Density of the host, the vCPUs of the powered on VMs share its threads
+			if metrics := hostExtraMetrics[*vm.Summary.Runtime.Host]; metrics != nil {
+				metrics["vm_count"]++
+				if vm.Summary.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn && vm.Summary.Config.NumCpu > 0 {
+					metrics["vcpu_count"] += int64(vm.Summary.Config.NumCpu)
+				}
+			}
+		}
 	}
 
 	// get object names
-	objects := []mo.ManagedEntity{}
-
-	//object for propery collection
-	propSpec := &types.PropertySpec{Type: "ManagedEntity", PathSet: []string{"name"}}
-	var objectSet []types.ObjectSpec
-	for _, mor := range mors {
-		objectSet = append(objectSet, types.ObjectSpec{Obj: mor, Skip: types.NewBool(false)})
-	}
-
-	//retrieve name property
-	propreq := types.RetrieveProperties{SpecSet: []types.PropertyFilterSpec{{ObjectSet: objectSet, PropSet: []types.PropertySpec{*propSpec}}}}
-	propres, err := client.PropertyCollector().RetrieveProperties(ctx, propreq)
-	if err != nil {
-		errlog.Println("Could not retrieve object names from vcenter: " + vcenter.Hostname)
-		errlog.Println("Error: ", err)
-		return
-	}
-
-	//load retrieved properties
-	err = mo.LoadRetrievePropertiesResponse(propres, &objects)
+	morToName, morToPath, err := vcenter.objectNames(ctx, client, mors, config.NameCacheCycles, config.NameTags.InventoryPath)
 	if err != nil {
 		errlog.Println("Could not retrieve object names from vcenter: " + vcenter.Hostname)
 		errlog.Println("Error: ", err)
-		return
+		scrapeErrors["retrieve"]++
+		return err
 	}
 
-	//create a map to resolve object names
-	morToName := make(map[types.ManagedObjectReference]string)
-	for _, object := range objects {
-		morToName[object.Self] = object.Name
-	}
-
-	//create a map to resolve metric names
-	metricToName := make(map[int32]string)
-	for _, metricgroup := range vcenter.MetricGroups {
-		for _, metricdef := range metricgroup.Metrics {
-			metricToName[metricdef.Key] = metricdef.Metric
+	// Map the VMs and hosts to their owners in a measurement of their own
+	if config.Ownership.enabled() && vcenter.collectType(config, "Ownership") {
+		rpcStart = time.Now()
+		points, err := vcenter.ownershipPoints(ctx, pc, client.ServiceContent.CustomFieldsManager, [][]types.ManagedObjectReference{vmRefs, hostRefs}, morToName, config, config.vCenterTags(vcName))
+		timings.Track("Ownership", rpcStart)
+		if err != nil {
+			errlog.Println("Could not retrieve the owners of the entities from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
 		}
+		inventoryPoints = append(inventoryPoints, points...)
 	}
 
+	metricDefs := metricDefinitions(vcenter.MetricGroups)
+
 	// Create Queries from interesting objects and requested metrics
 
 	queries := []types.PerfQuerySpec{}
 
 	// Common parameters
 	intervalIDint := 20
+	if vcenter.IntervalID != 0 {
+		intervalIDint = vcenter.IntervalID
+	}
 	var intervalID int32
 	intervalID = int32(intervalIDint)
 
+	// Historical intervals are rolled up late, so make sure the window holds at least one sample
+	window := config.Interval
+	if intervalIDint != 20 && window < 2*intervalIDint {
+		window = 2 * intervalIDint
+	}
+
 	endTime := time.Now().Add(time.Duration(-1) * time.Second)
-	startTime := endTime.Add(time.Duration(-config.Interval) * time.Second)
+	if config.UseVCenterClock {
+		endTime = endTime.Add(vcenter.clockSkew)
+	}
+	startTime := endTime.Add(time.Duration(-window) * time.Second)
+	// Continue from the end of the last successful collection so long or skipped cycles leave no gap.
+	// Historical samples are rolled up late, so their window is not continued.
+	if config.ContinueWindow && intervalIDint == 20 && !vcenter.lastEndTime.IsZero() && vcenter.lastEndTime.Before(endTime) {
+		startTime = vcenter.lastEndTime
+	}
+	// Overlap the previous window so delayed cycles do not leave gaps, already written samples are skipped
+	if config.OverlapSeconds > 0 {
+		startTime = startTime.Add(time.Duration(-config.OverlapSeconds) * time.Second)
+		if vcenter.lastSamples == nil {
+			vcenter.lastSamples = make(map[types.ManagedObjectReference]time.Time)
+		}
+	}
+	// Real-time samples are only kept for an hour, an older start would return nothing
+	if intervalIDint == 20 && endTime.Sub(startTime) > realtimeRetention {
+		startTime = endTime.Add(-realtimeRetention)
+	}
+
+	// Rollups of a counter sharing the samples of another one are not queried
+	rollupSiblings := make(map[metricKey][]int32)
+	sharedRollups := make(map[metricKey]bool)
+	if config.ShareRollups {
+		rollupSiblings, sharedRollups, _ = vcenter.rollupSiblings()
+	}
+
+	// Number of counters requested per entity, to report how many are returned
+	requestedCounters := make(map[types.ManagedObjectReference]int)
 
 	// Parse objects
 	for _, mor := range mors {
+		if !vcenter.collectType(config, mor.Type) {
+			continue
+		}
 		metricIds := []types.PerfMetricId{}
 		for _, metricgroup := range vcenter.MetricGroups {
 			if metricgroup.ObjectType == mor.Type {
 				for _, metricdef := range metricgroup.Metrics {
+					if sharedRollups[metricKey{ObjectType: mor.Type, Key: metricdef.Key}] {
+						continue
+					}
 					metricIds = append(metricIds, types.PerfMetricId{CounterId: metricdef.Key, Instance: metricdef.Instances})
 				}
 			}
 		}
-		queries = append(queries, types.PerfQuerySpec{Entity: mor, StartTime: &startTime, EndTime: &endTime, MetricId: metricIds, IntervalId: intervalID})
+		requestedCounters[mor] = countCounters(metricIds)
+		queries = append(queries, types.PerfQuerySpec{Entity: mor, StartTime: &startTime, EndTime: &endTime, MaxSample: int32(config.MaxSample), MetricId: metricIds, IntervalId: intervalID})
 	}
 
-	// Query the performances
-	perfreq := types.QueryPerf{This: *client.ServiceContent.PerfManager, QuerySpec: queries}
-	perfres, err := methods.QueryPerf(ctx, client.RoundTripper, &perfreq)
-	if err != nil {
-		errlog.Println("Could not request perfs from vcenter: " + vcenter.Hostname)
-		errlog.Println("Error: ", err)
-		return
+	// Query the performances by priority tier, unless no counter matched in which case only the inventory is collected
+	tiers := config.priorityTiers(queries)
+	if len(vcenter.MetricGroups) == 0 {
+		errlog.Println("Warning: no performance counters to query on vcenter: ", vcenter.Hostname, ", collecting its inventory only")
+		tiers = nil
 	}
 
 	// Get the result
-	vcName := strings.Replace(vcenter.Hostname, config.Domain, "", -1)
+	var points []*influxclient.Point
 
-	//Influx batch points
-	bp, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
-		Database:  config.InfluxDB.Database,
-		Precision: "s",
-	})
-	if err != nil {
-		errlog.Println(err)
-		return
+	// Decimal places of the float fields configured per metric
+	fieldDecimals := make(map[string]int)
+	for _, metricgroup := range vcenter.MetricGroups {
+		for _, metricdef := range metricgroup.Metrics {
+			if metricdef.Decimals != nil {
+				fieldDecimals[config.fieldName(strings.ToLower(metricdef.Metric))] = *metricdef.Decimals
+			}
+		}
 	}
 
-	for _, base := range perfres.Returnval {
-		pem := base.(*types.PerfEntityMetric)
-		entityName := strings.ToLower(pem.Entity.Type)
-		name := strings.ToLower(strings.Replace(morToName[pem.Entity], config.Domain, "", -1))
+	// Retention policies the fields of some metrics are written to instead of the default one
+	fieldPolicies := make(map[string]string)
+	for _, metricgroup := range vcenter.MetricGroups {
+		for _, metricdef := range metricgroup.Metrics {
+			if metricdef.RetentionPolicy != "" {
+				fieldPolicies[config.fieldName(strings.ToLower(metricdef.Metric))] = metricdef.RetentionPolicy
+			}
+		}
+	}
+
+	// Fields excluded from the output, accepted either as metric or field names
+	excludedFields := make(map[string]bool)
+	for _, field := range config.ExcludeFields {
+		excludedFields[strings.ToLower(strings.Replace(field, ".", "_", -1))] = true
+	}
+
+	// Counters returned over all the entities
+	returnedCounters := 0
 
-		//Create map for InfluxDB fields
-		fields := make(map[string]interface{})
+	// Fields already reported as set by several counters on the same point
+	duplicateFields := make(map[string]bool)
 
-		// Create map for InfluxDB tags
-		tags := map[string]string{"host": vcName, "name": name}
+	// Number of instances over the cap per measurement, logged once per cycle
+	cappedInstances := make(map[string]int)
 
-		// Add extra per VM tags
-		if summary, ok := vmSummary[pem.Entity]; ok {
-			for key, tag := range summary {
-				tags[key] = tag
+	// Number of results skipped per unexpected type, logged once per cycle
+	unexpectedSeries := make(map[string]int)
+	// Newest sample of each entity in this cycle, marked as written once the write succeeds
+	cycleSamples := make(map[types.ManagedObjectReference]time.Time)
+
+	// Per datastore counters of the hosts, written when no datastore counters are returned
+	datastoreFallback := NewDatastoreFallback()
+	datastoreEntities := false
+
+	// One point per ResourcePool with its configured limits and its runtime usage
+	if config.Collect.resourcePools() && vcenter.collectType(config, "ResourcePool") {
+		for _, pool := range rpmo {
+			summary := pool.Summary.GetResourcePoolSummary()
+			respoolFields := map[string]interface{}{
+				"cpu_limit":    summary.Config.CpuAllocation.GetResourceAllocationInfo().Limit,
+				"memory_limit": summary.Config.MemoryAllocation.GetResourceAllocationInfo().Limit,
 			}
-		}
-		if summary, ok := hostSummary[pem.Entity]; ok {
-			for key, tag := range summary {
-				tags[key] = tag
+			addSharesFields(respoolFields, "cpu", summary.Config.CpuAllocation.GetResourceAllocationInfo())
+			addSharesFields(respoolFields, "memory", summary.Config.MemoryAllocation.GetResourceAllocationInfo())
+			addPoolUsageFields(respoolFields, "cpu", summary.Runtime.Cpu)
+			addPoolUsageFields(respoolFields, "memory", summary.Runtime.Memory)
+			respoolTags := map[string]string{"pool_name": summary.Name}
+			pt3, err := influxclient.NewPoint(config.measurementName("ResourcePool", "resourcepool"), respoolTags, respoolFields, time.Now())
+			if err != nil {
+				errlog.Println(err)
+				continue
 			}
+			entityPoints["ResourcePool"] = append(entityPoints["ResourcePool"], pt3)
+		}
+	}
+	// Add the cluster status points
+	for cluster, clusterFields := range clusterMetrics {
+		clusterTags := config.vCenterTags(vcName)
+		clusterTags["cluster"] = clusterNames[cluster]
+		roundFields(clusterFields, fieldDecimals, config.Decimals)
+		pt, err := influxclient.NewPoint(config.measurementName("ClusterComputeResource", "cluster"), clusterTags, clusterFields, time.Now())
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		entityPoints["ClusterComputeResource"] = append(entityPoints["ClusterComputeResource"], pt)
+	}
+
+	// Points of the higher priority tiers, kept for the processors, and the number of points already written
+	var flushedPoints []*influxclient.Point
+	writtenPoints := 0
+
+	// Normalize the tag values and the timestamps of the points before they are written
+	finishPoints := func(points []*influxclient.Point) []*influxclient.Point {
+		if len(config.TagValueRewrites) > 0 {
+			points = rewriteTags(points, config.TagValueRewrites, nil)
 		}
+		if len(config.cardinalityRules) > 0 {
+			points = reduceCardinality(points, config.cardinalityRules, vcenter.Hostname)
+		}
+		// Stamp every point of the cycle with the same timestamp
+		if config.AlignTimestamps {
+			points = alignPoints(points, cycleTime)
+		}
+		return points
+	}
 
-		if summary, ok := respoolSummary[pem.Entity]; ok {
-			for key, tag := range summary {
-				tags[key] = tag
+	for index, tier := range tiers {
+		var perfResults []types.BasePerfEntityMetricBase
+		if len(tier.Queries) > 0 {
+			rpcStart = time.Now()
+			perfResults, err = vcenter.queryPerf(ctx, client, tier.Queries, time.Duration(config.EmptyPerfRetryDelay)*time.Second)
+			timings.Track("QueryPerf", rpcStart)
+			if err != nil {
+				errlog.Println("Could not request perfs from vcenter: " + vcenter.Hostname)
+				errlog.Println("Error: ", err)
+				scrapeErrors["queryperf"]++
+				return err
 			}
 		}
 
-		specialFields := make(map[string]map[string]map[string]map[string]interface{})
-		specialTags := make(map[string]map[string]map[string]map[string]string)
-		nowTime := time.Now()
-		for _, baseserie := range pem.Value {
-			serie := baseserie.(*types.PerfMetricIntSeries)
-			metricName := strings.ToLower(metricToName[serie.Id.CounterId])
-			influxMetricName := strings.Replace(metricName, ".", "_", -1)
-			instanceName := strings.ToLower(strings.Replace(serie.Id.Instance, ".", "_", -1))
-			measurementName := strings.Split(metricName, ".")[0]
+		// Size the points once per tier, as every series yields at most one point
+		points = make([]*influxclient.Point, 0, estimatePoints(perfResults)+len(entityPoints[tier.ObjectType])+len(inventoryPoints)+1)
+		if tier.ObjectType != "" {
+			points = append(points, entityPoints[tier.ObjectType]...)
+			delete(entityPoints, tier.ObjectType)
+		}
+
+		// Stop building points when the cycle is cancelled, the points of the complete entities are still written
+	entities:
+		for _, pem := range entityMetrics(perfResults, unexpectedSeries) {
+			if ctx.Err() != nil {
+				break
+			}
+			if pem.Entity.Type == "Datastore" && len(pem.Value) > 0 {
+				datastoreEntities = true
+			}
+			entityName := config.measurementName(pem.Entity.Type, strings.ToLower(pem.Entity.Type))
+			name := strings.ToLower(config.stripName(morToName[pem.Entity]))
+
+			//Create map for InfluxDB fields
+			fields := make(map[string]interface{})
 
-			if strings.Index(influxMetricName, "datastore") != -1 {
-				instanceName = ""
+			// Create map for InfluxDB tags
+			tags := config.vCenterTags(vcName)
+			tags["name"] = name
+			if config.NameTags.Full {
+				tags["name_full"] = strings.ToLower(morToName[pem.Entity])
+			}
+			if config.NameTags.InventoryPath && morToPath[pem.Entity] != "" {
+				tags["inventory_path"] = morToPath[pem.Entity]
 			}
 
-			var value int64 = -1
-			if strings.HasSuffix(metricName, ".average") {
-				value = average(serie.Value...)
-			} else if strings.HasSuffix(metricName, ".maximum") {
-				value = max(serie.Value...)
-			} else if strings.HasSuffix(metricName, ".minimum") {
-				value = min(serie.Value...)
-			} else if strings.HasSuffix(metricName, ".latest") {
-				value = serie.Value[len(serie.Value)-1]
-			} else if strings.HasSuffix(metricName, ".summation") {
-				value = sum(serie.Value...)
+			// Add extra per VM tags
+			if summary, ok := vmSummary[pem.Entity]; ok {
+				for key, tag := range summary {
+					tags[key] = tag
+				}
+			}
+			if summary, ok := hostSummary[pem.Entity]; ok {
+				for key, tag := range summary {
+					tags[key] = tag
+				}
 			}
 
-			if instanceName == "" {
-				fields[influxMetricName] = value
-			} else {
-				// init maps
-				if specialFields[measurementName] == nil {
-					specialFields[measurementName] = make(map[string]map[string]map[string]interface{})
-					specialTags[measurementName] = make(map[string]map[string]map[string]string)
+			if summary, ok := respoolSummary[pem.Entity]; ok {
+				for key, tag := range summary {
+					tags[key] = tag
+				}
+			}
+
+			specialFields := make(map[string]map[string]map[string]map[string]interface{})
+			specialTags := make(map[string]map[string]map[string]map[string]string)
+			// Fields of metrics with their own tags, grouped by tag set
+			taggedFields := make(map[string]map[string]interface{})
+			taggedTags := make(map[string]map[string]string)
+			nowTime := time.Now()
+			lastSample := time.Time{}
+			if config.OverlapSeconds > 0 && len(pem.SampleInfo) > 0 {
+				// Timestamp the points with their newest sample so overlapping windows overwrite each other
+				lastSample = vcenter.lastSamples[pem.Entity]
+				nowTime = pem.SampleInfo[len(pem.SampleInfo)-1].Timestamp
+				cycleSamples[pem.Entity] = nowTime
+			}
+			if config.PerfCoverage && requestedCounters[pem.Entity] > 0 {
+				returned := countSeriesCounters(pem.Value)
+				returnedCounters += returned
+				fields["perf_coverage"] = percent(int64(returned), int64(requestedCounters[pem.Entity]))
+			}
+			if config.ShareRollups {
+				pem.Value = shareRollups(pem.Value, pem.Entity.Type, rollupSiblings)
+			}
+			for _, serie := range intSeries(pem.Value, unexpectedSeries) {
+				if ctx.Err() != nil {
+					break entities
+				}
+				values := newSamples(serie.Value, pem.SampleInfo, lastSample)
+				if len(values) == 0 {
+					continue
+				}
+				metricdef := metricDefs[metricKey{ObjectType: pem.Entity.Type, Key: serie.Id.CounterId}]
+				metricName := strings.ToLower(metricdef.Metric)
+				influxMetricName := config.fieldName(metricName)
+				instanceName := strings.ToLower(strings.Replace(serie.Id.Instance, ".", "_", -1))
+				measurementName := strings.Split(metricName, ".")[0]
+
+				if strings.Index(influxMetricName, "datastore") != -1 {
+					instanceName = ""
+				}
+
+				// Too few samples would be graphed as a stable value
+				minSamples := config.MinSamples
+				if metricdef.MinSamples > 0 {
+					minSamples = metricdef.MinSamples
+				}
+				sampleCount := validSamples(values)
+				if metricdef.AllowNegative {
+					// Only the -1 sentinel of vSphere marks a missing sample, other negative values are kept
+					values = presentSamples(values)
+					sampleCount = len(values)
+					if sampleCount == 0 {
+						continue
+					}
+				}
+				if minSamples > 0 && sampleCount < minSamples {
+					continue
+				}
+
+				// Average every Downsample samples before reducing them
+				if metricdef.Downsample > 1 {
+					values = downsample(values, metricdef.Downsample, metricdef.AllowNegative)
+				}
+
+				var value int64 = -1
+				if metricdef.AllowNegative {
+					if reduce, ok := signedReducers[config.reducer(metricName)]; ok {
+						value = reduce(values...)
+					}
+				} else if reduce, ok := reducers[config.reducer(metricName)]; ok {
+					value = reduce(values...)
+				}
 
+				// The datastore counters of the hosts are instanced by datastore UUID
+				if config.DatastoreFallback && pem.Entity.Type == "HostSystem" && measurementName == "datastore" && serie.Id.Instance != "" {
+					datastoreFallback.Add(serie.Id.Instance, influxMetricName, value)
 				}
 
-				if specialFields[measurementName][tags["name"]] == nil {
-					specialFields[measurementName][tags["name"]] = make(map[string]map[string]interface{})
-					specialTags[measurementName][tags["name"]] = make(map[string]map[string]string)
+				// Scaled values are always written as floats, so their missing value marker is left out rather than
+				// written as an integer the field type would conflict with
+				var fieldValue interface{} = value
+				if metricdef.Scale != 0 {
+					if value < 0 && !metricdef.AllowNegative {
+						continue
+					}
+					fieldValue = float64(value) * metricdef.Scale
 				}
 
-				if specialFields[measurementName][tags["name"]][instanceName] == nil {
-					specialFields[measurementName][tags["name"]][instanceName] = make(map[string]interface{})
-					specialTags[measurementName][tags["name"]][instanceName] = make(map[string]string)
+				if excludedFields[influxMetricName] || excludedFields[strings.Replace(metricName, ".", "_", -1)] {
+					continue
+				}
 
+				// Contention summations are hard to read, so add their share of the sampling interval
+				derivedField := ""
+				var derivedValue float64
+				if field, ok := contentionFields[metricName]; ok && !excludedFields[field] {
+					derivedField = field
+					derivedValue = contentionPercent(values, int64(intervalIDint)*1000)
 				}
 
-				specialFields[measurementName][tags["name"]][instanceName][influxMetricName] = value
+				metricTags := metricdef.Tags
+				if instanceName == "" && len(metricTags) > 0 {
+					tagSet := tagSetKey(metricTags)
+					if taggedFields[tagSet] == nil {
+						taggedFields[tagSet] = make(map[string]interface{})
+						taggedTags[tagSet] = make(map[string]string)
+						for k, v := range tags {
+							taggedTags[tagSet][k] = v
+						}
+						for k, v := range metricTags {
+							taggedTags[tagSet][k] = v
+						}
+					}
+					if _, ok := taggedFields[tagSet][influxMetricName]; ok {
+						warnDuplicateField(duplicateFields, entityName, influxMetricName, vcenter.Hostname)
+					}
+					taggedFields[tagSet][influxMetricName] = fieldValue
+					if derivedField != "" {
+						taggedFields[tagSet][derivedField] = derivedValue
+					}
+				} else if instanceName == "" {
+					if _, ok := fields[influxMetricName]; ok {
+						warnDuplicateField(duplicateFields, entityName, influxMetricName, vcenter.Hostname)
+					}
+					fields[influxMetricName] = fieldValue
+					if derivedField != "" {
+						fields[derivedField] = derivedValue
+					}
+				} else {
+					// Metrics with their own tags get their own point per instance
+					instanceKey := instanceName
+					if len(metricTags) > 0 {
+						instanceKey += "," + tagSetKey(metricTags)
+					}
+
+					// init maps
+					if specialFields[measurementName] == nil {
+						specialFields[measurementName] = make(map[string]map[string]map[string]interface{})
+						specialTags[measurementName] = make(map[string]map[string]map[string]string)
+
+					}
+
+					if specialFields[measurementName][tags["name"]] == nil {
+						specialFields[measurementName][tags["name"]] = make(map[string]map[string]interface{})
+						specialTags[measurementName][tags["name"]] = make(map[string]map[string]string)
+					}
+
+					if specialFields[measurementName][tags["name"]][instanceKey] == nil {
+						specialFields[measurementName][tags["name"]][instanceKey] = make(map[string]interface{})
+						specialTags[measurementName][tags["name"]][instanceKey] = make(map[string]string)
+
+					}
+
+					if _, ok := specialFields[measurementName][tags["name"]][instanceKey][influxMetricName]; ok {
+						warnDuplicateField(duplicateFields, measurementName, influxMetricName, vcenter.Hostname)
+					}
+					specialFields[measurementName][tags["name"]][instanceKey][influxMetricName] = fieldValue
+					if derivedField != "" {
+						specialFields[measurementName][tags["name"]][instanceKey][derivedField] = derivedValue
+					}
 
-				for k, v := range tags {
-					specialTags[measurementName][tags["name"]][instanceName][k] = v
+					for k, v := range tags {
+						specialTags[measurementName][tags["name"]][instanceKey][k] = v
+					}
+					for k, v := range metricTags {
+						specialTags[measurementName][tags["name"]][instanceKey][k] = v
+					}
+					specialTags[measurementName][tags["name"]][instanceKey]["instance"] = instanceName
 				}
-				specialTags[measurementName][tags["name"]][instanceName]["instance"] = instanceName
 			}
-		}
 
-		if metrics, ok := hostExtraMetrics[pem.Entity]; ok {
-			for key, value := range metrics {
-				fields[key] = value
+			if metrics, ok := hostExtraMetrics[pem.Entity]; ok {
+				for key, value := range metrics {
+					if excludedFields[key] {
+						continue
+					}
+					if _, ok := fields[key]; ok {
+						warnDuplicateField(duplicateFields, entityName, key, vcenter.Hostname)
+					}
+					fields[key] = value
+				}
+				if threads := metrics["cpu_corecount_total"]; threads > 0 && !excludedFields["vcpu_overcommit_ratio"] {
+					fields["vcpu_overcommit_ratio"] = float64(metrics["vcpu_count"]) / float64(threads)
+				}
+			}
+			if metrics, ok := vmExtraMetrics[pem.Entity]; ok {
+				for key, value := range metrics {
+					if excludedFields[key] {
+						continue
+					}
+					if _, ok := fields[key]; ok {
+						warnDuplicateField(duplicateFields, entityName, key, vcenter.Hostname)
+					}
+					fields[key] = value
+				}
 			}
-		}
 
-		//create InfluxDB points
-		pt, err := influxclient.NewPoint(entityName, tags, fields, nowTime)
-		if err != nil {
-			errlog.Println(err)
-			continue
-		}
-		bp.AddPoint(pt)
+			//create InfluxDB points
+			roundFields(fields, fieldDecimals, config.Decimals)
+			pt, err := influxclient.NewPoint(entityName, tags, fields, nowTime)
+			if err != nil {
+				errlog.Println(err)
+				continue
+			}
+			points = append(points, pt)
+
+			for tagSet, taggedValues := range taggedFields {
+				roundFields(taggedValues, fieldDecimals, config.Decimals)
+				taggedPoint, err := influxclient.NewPoint(entityName, taggedTags[tagSet], taggedValues, nowTime)
+				if err != nil {
+					errlog.Println(err)
+					continue
+				}
+				points = append(points, taggedPoint)
+			}
 
-		for measurement, v := range specialFields {
-			for name, metric := range v {
-				for instance, value := range metric {
-					pt2, err := influxclient.NewPoint(measurement, specialTags[measurement][name][instance], value, time.Now())
-					if err != nil {
-						errlog.Println(err)
-						continue
+			for measurement, v := range specialFields {
+				for name, metric := range v {
+					if capped := config.InstanceCap.capInstances(metric, specialTags[measurement][name], config.InstanceCap.max(measurement)); capped > 0 {
+						cappedInstances[measurement] += capped
+					}
+					for instance, value := range metric {
+						roundFields(value, fieldDecimals, config.Decimals)
+						pt2, err := influxclient.NewPoint(measurement, specialTags[measurement][name][instance], value, nowTime)
+						if err != nil {
+							errlog.Println(err)
+							continue
+						}
+						points = append(points, pt2)
 					}
-					bp.AddPoint(pt2)
 				}
 			}
 		}
 
-		var respool []mo.ResourcePool
-		err = pc.Retrieve(ctx, respoolRefs, []string{"name", "config", "vm"}, &respool)
-		if err != nil {
-			errlog.Println(err)
-			continue
+		// Write the points of a priority tier before querying the next one, so they are safe if the cycle overruns
+		if ctx.Err() != nil {
+			break
 		}
-
-		for _, pool := range respool {
-			respoolFields := map[string]interface{}{
-				"cpu_limit":    pool.Config.CpuAllocation.GetResourceAllocationInfo().Limit,
-				"memory_limit": pool.Config.MemoryAllocation.GetResourceAllocationInfo().Limit,
+		if index < len(tiers)-1 && len(points) > 0 {
+			flushedPoints = append(flushedPoints, points...)
+			tierPoints, ok := config.limitPoints(finishPoints(points), writtenPoints, vcenter.Hostname)
+			if !ok {
+				return nil
+			}
+			writeStart := time.Now()
+			err = writePoints(config, output, tierPoints, fieldPolicies)
+			status.WriteDuration += time.Since(writeStart)
+			for _, pt := range tierPoints {
+				status.Measurements[pt.Name()]++
 			}
-			respoolTags := map[string]string{"pool_name": pool.Name}
-			pt3, err := influxclient.NewPoint("resourcepool", respoolTags, respoolFields, time.Now())
 			if err != nil {
 				errlog.Println(err)
-				continue
+				scrapeErrors["write"]++
+				return writeError{err}
 			}
-			bp.AddPoint(pt3)
+			writtenPoints += len(tierPoints)
+			stdlog.Println("sent ", len(tierPoints), " points of priority tier ", tier.ObjectType, " to outputs")
+		}
+	}
+
+	if ctx.Err() != nil {
+		errlog.Println("Point building of vcenter ", vcenter.Hostname, " was cancelled, writing the ", len(points), " points built so far")
+	}
+
+	// Approximate the datastore counters from the ones of the hosts
+	if config.DatastoreFallback && !datastoreEntities && !datastoreFallback.Empty() {
+		names, err := datastoreNames(ctx, pc, hsmo)
+		if err != nil {
+			errlog.Println("Could not retrieve datastores from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			scrapeErrors["retrieve"]++
+		} else {
+			points = append(points, datastoreFallback.Points(names, config, config.vCenterTags(vcName), time.Now())...)
 		}
+	}
+
+	// The inventory points of the types without a tier of their own are written with the last tier
+	entityTypes := []string{}
+	for objectType := range entityPoints {
+		entityTypes = append(entityTypes, objectType)
+	}
+	sort.Strings(entityTypes)
+	for _, objectType := range entityTypes {
+		points = append(points, entityPoints[objectType]...)
+	}
+	points = append(points, inventoryPoints...)
 
+	// A cycle without points almost always means a misconfiguration or a vCenter problem
+	minPoints := config.MinPointsPerCycle
+	if minPoints <= 0 {
+		minPoints = 1
+	}
+	empty := len(flushedPoints)+len(points) < minPoints
+	if empty {
+		errlog.Println("WARNING: vcenter ", vcenter.Hostname, " produced ", len(flushedPoints)+len(points), " points, fewer than MinPointsPerCycle ", minPoints)
+		scrapeErrors["empty"]++
 	}
 
-	//InfluxDB send
-	err = InfluxDBClient.Write(bp)
+	// Add the vCenter RPC timings
+	rpcPoint, err := influxclient.NewPoint("collector_rpc", config.vCenterTags(vcName), timings.Fields(), time.Now())
 	if err != nil {
 		errlog.Println(err)
-		return
+	} else {
+		points = append(points, rpcPoint)
 	}
 
-	stdlog.Println("sent data to Influxdb")
-}
+	for seriesType, count := range unexpectedSeries {
+		errlog.Println("Warning: skipped ", count, " performance results of unexpected type ", seriesType, " from vcenter: ", vcenter.Hostname)
+	}
+	for measurement, capped := range cappedInstances {
+		stdlog.Println("Capped ", capped, " ", measurement, " instances over the InstanceCap of vcenter: ", vcenter.Hostname)
+	}
+
+	// Derive the metrics of the processors, from the points of the tiers already written too
+	processed := append(flushedPoints, points...)
+	for _, processor := range newPointProcessors(config, config.vCenterTags(vcName)) {
+		processed = processor.Process(processed)
+	}
+	points = finishPoints(processed[len(flushedPoints):])
+
+	// Protect the outputs against a cardinality explosion
+	points, ok := config.limitPoints(points, writtenPoints, vcenter.Hostname)
+	if !ok {
+		return nil
+	}
+	// Summarize how much of the requested metric set vCenter satisfied
+	if config.PerfCoverage {
+		requested := 0
+		for _, count := range requestedCounters {
+			requested += count
+		}
+		stdlog.Println("vcenter ", vcenter.Hostname, " returned ", returnedCounters, " of ", requested, " requested counters for ", len(requestedCounters), " entities")
+	}
+
+	//Outputs send
+	writeStart := time.Now()
+	err = writePoints(config, output, points, fieldPolicies)
+	status.WriteDuration += time.Since(writeStart)
+	for _, pt := range points {
+		status.Measurements[pt.Name()]++
+	}
+	if err != nil {
+		errlog.Println(err)
+		scrapeErrors["write"]++
+		return writeError{err}
+	}
+	status.Points = writtenPoints + len(points)
+	status.Success = true
+	vcenter.lastEndTime = endTime
+	vcenter.markSamplesWritten(cycleSamples)
+
+	// The lag is measured on the collector's clock, the query window may follow the vCenter clock
+	status.Lag = time.Since(endTime)
+	if config.UseVCenterClock {
+		status.Lag += vcenter.clockSkew
+	}
+
+	stdlog.Println("sent data to outputs")
+	if empty {
+		return errEmptyCollection
+	}
+	return nil
+}
+
+// isWriteError tells whether a collection failed to write its points
+func isWriteError(err error) bool {
+	_, ok := err.(writeError)
+	return ok
+}
+
+// versionLess tells if the dotted version a is lower than b
+func versionLess(a, b string) bool {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum != bNum {
+			return aNum < bNum
+		}
+	}
+	return false
+}
+
+// Services and firewall rulesets reported by default when collecting host services
+var (
+	defaultMonitoredServices = []string{"TSM-SSH", "TSM"}
+	defaultMonitoredRulesets = []string{"sshServer"}
+)
+
+// addHostServicesMetrics adds the running state of the monitored services and
+// the enabled state of the monitored firewall rulesets of a host
+func addHostServicesMetrics(metrics map[string]int64, host mo.HostSystem, config Configuration) {
+	if host.Config == nil {
+		return
+	}
+	monitoredServices := config.MonitoredServices
+	if len(monitoredServices) == 0 {
+		monitoredServices = defaultMonitoredServices
+	}
+	monitoredRulesets := config.MonitoredRulesets
+	if len(monitoredRulesets) == 0 {
+		monitoredRulesets = defaultMonitoredRulesets
+	}
+	fieldName := strings.NewReplacer("-", "_", ".", "_", " ", "_")
+
+	if host.Config.Service != nil {
+		for _, service := range host.Config.Service.Service {
+			for _, monitored := range monitoredServices {
+				if service.Key == monitored {
+					var running int64
+					if service.Running {
+						running = 1
+					}
+					metrics["service_"+strings.ToLower(fieldName.Replace(service.Key))+"_running"] = running
+				}
+			}
+		}
+	}
+
+	if host.Config.Firewall != nil {
+		for _, ruleset := range host.Config.Firewall.Ruleset {
+			for _, monitored := range monitoredRulesets {
+				if ruleset.Key == monitored {
+					var enabled int64
+					if ruleset.Enabled {
+						enabled = 1
+					}
+					metrics["firewall_"+strings.ToLower(fieldName.Replace(ruleset.Key))+"_enabled"] = enabled
+				}
+			}
+		}
+	}
+}
+
+// drsBehaviors codes the cluster DRS automation levels as numbers
+var drsBehaviors = map[types.DrsBehavior]int64{
+	types.DrsBehaviorManual:             0,
+	types.DrsBehaviorPartiallyAutomated: 1,
+	types.DrsBehaviorFullyAutomated:     2,
+}
+
+// overallStatuses codes the overall status of the entities
+var overallStatuses = map[types.ManagedEntityStatus]int64{
+	types.ManagedEntityStatusGreen:  0,
+	types.ManagedEntityStatusYellow: 1,
+	types.ManagedEntityStatusRed:    2,
+	types.ManagedEntityStatusGray:   3,
+}
+
+// vmConnectionStateFields are the host fields counting the VMs per connection state
+var vmConnectionStateFields = map[types.VirtualMachineConnectionState]string{
+	types.VirtualMachineConnectionStateConnected:    "vms_connected",
+	types.VirtualMachineConnectionStateDisconnected: "vms_disconnected",
+	types.VirtualMachineConnectionStateOrphaned:     "vms_orphaned",
+	types.VirtualMachineConnectionStateInaccessible: "vms_inaccessible",
+	types.VirtualMachineConnectionStateInvalid:      "vms_invalid",
+}
+
+// addHostHardwareTags adds the vendor, model, BIOS version and serial number of a host to its tags
+func addHostHardwareTags(tags map[string]string, host mo.HostSystem) {
+	if hardware := host.Summary.Hardware; hardware != nil {
+		tags["vendor"] = hardware.Vendor
+		tags["model"] = hardware.Model
+		for _, info := range hardware.OtherIdentifyingInfo {
+			if info.IdentifierType == nil {
+				continue
+			}
+			switch info.IdentifierType.GetElementDescription().Key {
+			case "SerialNumberTag", "ServiceTag":
+				tags["serial"] = info.IdentifierValue
+			}
+		}
+	}
+	if host.Hardware != nil && host.Hardware.BiosInfo != nil {
+		tags["bios_version"] = host.Hardware.BiosInfo.BiosVersion
+	}
+}
+
+// latencySensitivityLevels codes the VM latency sensitivity levels as numbers
+var latencySensitivityLevels = map[types.LatencySensitivitySensitivityLevel]int64{
+	types.LatencySensitivitySensitivityLevelLow:    0,
+	types.LatencySensitivitySensitivityLevelNormal: 1,
+	types.LatencySensitivitySensitivityLevelMedium: 2,
+	types.LatencySensitivitySensitivityLevelHigh:   3,
+	types.LatencySensitivitySensitivityLevelCustom: 4,
+}
+
+// NTP status codes of the hosts
+const (
+	ntpRunning       = 0
+	ntpStopped       = 1
+	ntpNotConfigured = 2
+)
+
+// addHostTimeMetrics adds whether NTP servers are configured and the ntpd service is running, as 0 or 1, and
+// the coded ntp_status: 0 when running, 1 when configured but stopped, 2 when not configured
+func addHostTimeMetrics(metrics map[string]int64, host mo.HostSystem) {
+	if host.Config == nil {
+		return
+	}
+	var configured, running int64
+	if host.Config.DateTimeInfo != nil && host.Config.DateTimeInfo.NtpConfig != nil && len(host.Config.DateTimeInfo.NtpConfig.Server) > 0 {
+		configured = 1
+	}
+	if host.Config.Service != nil {
+		for _, service := range host.Config.Service.Service {
+			if service.Key == "ntpd" && service.Running {
+				running = 1
+			}
+		}
+	}
+	metrics["ntp_configured"] = configured
+	metrics["ntp_running"] = running
+	switch {
+	case configured == 0:
+		metrics["ntp_status"] = ntpNotConfigured
+	case running == 0:
+		metrics["ntp_status"] = ntpStopped
+	default:
+		metrics["ntp_status"] = ntpRunning
+	}
+}
+
+// addVMTuningMetrics adds the latency sensitivity level and the number of CPUs the VM is pinned to, 0 when not pinned
+func addVMTuningMetrics(metrics map[string]int64, vmConfig *types.VirtualMachineConfigInfo) {
+	metrics["latency_sensitivity"] = latencySensitivityLevels[types.LatencySensitivitySensitivityLevelNormal]
+	if vmConfig.LatencySensitivity != nil {
+		metrics["latency_sensitivity"] = latencySensitivityLevels[vmConfig.LatencySensitivity.Level]
+	}
+	metrics["cpu_affinity_count"] = 0
+	if vmConfig.CpuAffinity != nil {
+		metrics["cpu_affinity_count"] = int64(len(vmConfig.CpuAffinity.AffinitySet))
+	}
+}
+
+// addVMCapabilitiesMetrics adds whether CPU and memory hot-add are enabled, as 0 or 1, and the virtual hardware version
+func addVMCapabilitiesMetrics(metrics map[string]int64, vmConfig *types.VirtualMachineConfigInfo) {
+	metrics["cpu_hotadd_enabled"] = 0
+	if boolValue(vmConfig.CpuHotAddEnabled) {
+		metrics["cpu_hotadd_enabled"] = 1
+	}
+	metrics["memory_hotadd_enabled"] = 0
+	if boolValue(vmConfig.MemoryHotAddEnabled) {
+		metrics["memory_hotadd_enabled"] = 1
+	}
+	// The version is reported as vmx-13 for instance
+	if version, err := strconv.ParseInt(strings.TrimPrefix(vmConfig.Version, "vmx-"), 10, 64); err == nil {
+		metrics["hardware_version"] = version
+	}
+}
+
+// boolValue returns the value of an optional boolean, false when unset
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
+
+// sharesLevels codes the resource allocation shares levels as numbers
+var sharesLevels = map[types.SharesLevel]int64{
+	types.SharesLevelLow:    0,
+	types.SharesLevelNormal: 1,
+	types.SharesLevelHigh:   2,
+	types.SharesLevelCustom: 3,
+}
+
+// addSharesFields adds the shares value and coded level of a resource allocation to fields
+func addSharesFields(fields map[string]interface{}, prefix string, allocation *types.ResourceAllocationInfo) {
+	if allocation == nil || allocation.Shares == nil {
+		return
+	}
+	fields[prefix+"_shares"] = int64(allocation.Shares.Shares)
+	if level, ok := sharesLevels[allocation.Shares.Level]; ok {
+		fields[prefix+"_shares_level"] = level
+	}
+}
+
+// addPoolUsageFields adds the reservations and the usage of a ResourcePool, in MHz for the CPU and bytes for the memory
+func addPoolUsageFields(fields map[string]interface{}, prefix string, usage types.ResourcePoolResourceUsage) {
+	fields[prefix+"_reservation_used"] = usage.ReservationUsed
+	fields[prefix+"_reservation_used_vm"] = usage.ReservationUsedForVm
+	fields[prefix+"_unreserved_pool"] = usage.UnreservedForPool
+	fields[prefix+"_unreserved_vm"] = usage.UnreservedForVm
+	fields[prefix+"_overall_usage"] = usage.OverallUsage
+	fields[prefix+"_max_usage"] = usage.MaxUsage
+}
+
+// database returns the database a measurement is routed to
+func (config Configuration) database(measurement string) string {
+	if routed, ok := config.MeasurementRouting[measurement]; ok {
+		return routed
+	}
+	return config.InfluxDB.Database
+}
+
+// batchTarget identifies the batch of a database and retention policy
+type batchTarget struct {
+	Database        string
+	RetentionPolicy string
+}
+
+// writePoints sends the points to the outputs, batched by the database their measurement is routed to.
+// The fields of the metrics with a retention policy are split off their point into a batch of that policy.
+func writePoints(config Configuration, output Output, points []*influxclient.Point, fieldPolicies map[string]string) error {
+	batches := make(map[batchTarget]influxclient.BatchPoints)
+	targets := []batchTarget{}
+	batch := func(target batchTarget) (influxclient.BatchPoints, error) {
+		if bp, ok := batches[target]; ok {
+			return bp, nil
+		}
+		bp, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
+			Database:        target.Database,
+			RetentionPolicy: target.RetentionPolicy,
+			Precision:       "s",
+		})
+		if err != nil {
+			return nil, err
+		}
+		batches[target] = bp
+		targets = append(targets, target)
+		return bp, nil
+	}
+
+	// Without routing, every point goes to the default database in a single batch
+	if len(config.MeasurementRouting) == 0 && len(fieldPolicies) == 0 {
+		bp, err := batch(batchTarget{Database: config.InfluxDB.Database})
+		if err != nil {
+			return err
+		}
+		bp.AddPoints(points)
+		return output.Write(bp)
+	}
+
+	for _, pt := range points {
+		database := config.database(pt.Name())
+		policyPoints, err := splitRetentionPolicies(pt, fieldPolicies)
+		if err != nil {
+			return err
+		}
+		for policy, policyPoint := range policyPoints {
+			bp, err := batch(batchTarget{Database: database, RetentionPolicy: policy})
+			if err != nil {
+				return err
+			}
+			bp.AddPoint(policyPoint)
+		}
+	}
+
+	if len(targets) == 1 {
+		return output.Write(batches[targets[0]])
+	}
+
+	// The batches are independent, write them concurrently. MaxConcurrentWrites bounds the writes in flight.
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target batchTarget) {
+			defer wg.Done()
+			errs[i] = output.Write(batches[target])
+		}(i, target)
+	}
+	wg.Wait()
+
+	var lastErr error
+	for i, err := range errs {
+		if err != nil {
+			errlog.Println("Could not write ", len(batches[targets[i]].Points()), " points to database ", targets[i].Database, " retention policy ", targets[i].RetentionPolicy)
+			errlog.Println("Error: ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// splitRetentionPolicies splits the fields of a point by the retention policy they are written to,
+// the fields without a policy staying under the empty, default one
+func splitRetentionPolicies(pt *influxclient.Point, fieldPolicies map[string]string) (map[string]*influxclient.Point, error) {
+	if len(fieldPolicies) == 0 {
+		return map[string]*influxclient.Point{"": pt}, nil
+	}
+	fields, err := pt.Fields()
+	if err != nil {
+		return nil, err
+	}
+	policyFields := make(map[string]map[string]interface{})
+	for field, value := range fields {
+		policy := fieldPolicies[field]
+		if policyFields[policy] == nil {
+			policyFields[policy] = make(map[string]interface{})
+		}
+		policyFields[policy][field] = value
+	}
+	if _, ok := policyFields[""]; ok && len(policyFields) == 1 {
+		return map[string]*influxclient.Point{"": pt}, nil
+	}
+
+	policyPoints := make(map[string]*influxclient.Point)
+	for policy, values := range policyFields {
+		policyPoint, err := influxclient.NewPoint(pt.Name(), pt.Tags(), values, pt.Time())
+		if err != nil {
+			return nil, err
+		}
+		policyPoints[policy] = policyPoint
+	}
+	return policyPoints, nil
+}
+
+// writeScrapeErrors sends the number of errors per collection stage of a vCenter
+func writeScrapeErrors(vcName string, config Configuration, output Output, scrapeErrors map[string]int64) {
+	points := []*influxclient.Point{}
+	now := time.Now()
+	for stage, count := range scrapeErrors {
+		tags := config.vCenterTags(vcName)
+		tags["stage"] = stage
+		pt, err := influxclient.NewPoint("scrape_error", tags, map[string]interface{}{"count": count}, now)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		points = append(points, pt)
+	}
+
+	err := writePoints(config, output, points, nil)
+	if err != nil {
+		errlog.Println("Could not send scrape errors of vcenter: ", vcName)
+		errlog.Println("Error: ", err)
+	}
+}
+
+// writeCollectorStatus sends the collector_status point of a vCenter cycle
+func writeCollectorStatus(vcName string, config Configuration, output Output, status *CollectorStatus) {
+	if config.audit != nil {
+		config.audit.Record(vcName, config, status)
+	}
+
+	pt, err := influxclient.NewPoint("collector_status", config.vCenterTags(vcName), status.Fields(), time.Now())
+	if err != nil {
+		errlog.Println(err)
+		return
+	}
+
+	err = writePoints(config, output, []*influxclient.Point{pt}, nil)
+	if err != nil {
+		errlog.Println("Could not send the status of vcenter: ", vcName)
+		errlog.Println("Error: ", err)
+	}
+}
+
+// configFingerprint returns a SHA-256 hash of the configuration without its secrets
+func configFingerprint(config Configuration) string {
+	vcenters := []VCenter{}
+	for _, vcenter := range config.VCenters {
+		withoutSecrets := *vcenter
+		withoutSecrets.Password = ""
+		vcenters = append(vcenters, withoutSecrets)
+	}
+	outputs := []OutputConfig{}
+	for _, output := range config.Outputs {
+		output.Password = ""
+		outputs = append(outputs, output)
+	}
+	config.InfluxDB.Password = ""
+	config.Outputs = outputs
+	config.Vault.Token = ""
+
+	content, err := json.Marshal(struct {
+		Configuration
+		VCenters []VCenter
+	}{Configuration: config, VCenters: vcenters})
+	if err != nil {
+		errlog.Println("Could not fingerprint the configuration: ", err)
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// writeConfigFingerprint sends a collector_config point identifying the configuration and version in use
+func writeConfigFingerprint(config Configuration, output Output) {
+	hostname, _ := os.Hostname()
+	tags := map[string]string{"collector": hostname, "version": version}
+	fields := map[string]interface{}{"config_hash": config.fingerprint}
+	pt, err := influxclient.NewPoint("collector_config", tags, fields, time.Now())
+	if err != nil {
+		errlog.Println(err)
+		return
+	}
+
+	err = writePoints(config, output, []*influxclient.Point{pt}, nil)
+	if err != nil {
+		errlog.Println("Could not send the configuration fingerprint")
+		errlog.Println("Error: ", err)
+	}
+}
+
+// selectHosts returns the hosts among refs
+func selectHosts(hosts []mo.HostSystem, refs []types.ManagedObjectReference) []mo.HostSystem {
+	selected := make(map[types.ManagedObjectReference]bool)
+	for _, ref := range refs {
+		selected[ref] = true
+	}
+	filtered := []mo.HostSystem{}
+	for _, host := range hosts {
+		if selected[host.Self] {
+			filtered = append(filtered, host)
+		}
+	}
+	return filtered
+}
+
+// filterRefs keeps the references that are in the allowed set
+func filterRefs(refs []types.ManagedObjectReference, allowed map[types.ManagedObjectReference]bool) []types.ManagedObjectReference {
+	filtered := []types.ManagedObjectReference{}
+	for _, ref := range refs {
+		if allowed[ref] {
+			filtered = append(filtered, ref)
+		}
+	}
+	return filtered
+}
+
+// newSamples returns the values sampled after the given time, or every value when it is zero
+func newSamples(values []int64, samples []types.PerfSampleInfo, after time.Time) []int64 {
+	if after.IsZero() || len(samples) != len(values) {
+		return values
+	}
+	newValues := []int64{}
+	for i, sample := range samples {
+		if sample.Timestamp.After(after) {
+			newValues = append(newValues, values[i])
+		}
+	}
+	return newValues
+}
+
+// markSamplesWritten records the newest written sample of the entities, the older ones are skipped when
+// overlapping windows return them again
+func (vcenter *VCenter) markSamplesWritten(samples map[types.ManagedObjectReference]time.Time) {
+	if vcenter.lastSamples == nil {
+		vcenter.lastSamples = make(map[types.ManagedObjectReference]time.Time)
+	}
+	for entity, timestamp := range samples {
+		vcenter.lastSamples[entity] = timestamp
+	}
+}
+
+// warnDuplicateField warns once per cycle that several values were written to the same field of a point
+func warnDuplicateField(duplicateFields map[string]bool, measurement string, field string, vcenter string) {
+	key := measurement + "." + field
+	if duplicateFields[key] {
+		return
+	}
+	duplicateFields[key] = true
+	errlog.Println("Warning: several counters produce the field ", field, " of the same ", measurement, " point on vcenter: ", vcenter, ", only the last value is kept")
+}
+
+// priorityTier is a set of performance queries written before the following tiers, with the inventory points of
+// its object type. The last tier has no object type and holds everything else.
+type priorityTier struct {
+	ObjectType string
+	Queries    []types.PerfQuerySpec
+}
+
+// priorityTiers splits the queries into tiers queried and written in turn: one per object type of Priorities, in
+// order, then one with the other types. Without Priorities, every query is in a single tier.
+func (config Configuration) priorityTiers(queries []types.PerfQuerySpec) []priorityTier {
+	tiers := []priorityTier{}
+	rest := queries
+	for _, objectType := range config.Priorities {
+		tier := priorityTier{ObjectType: canonicalObjectType(objectType)}
+		others := []types.PerfQuerySpec{}
+		for _, query := range rest {
+			if strings.EqualFold(query.Entity.Type, objectType) {
+				tier.Queries = append(tier.Queries, query)
+			} else {
+				others = append(others, query)
+			}
+		}
+		tiers = append(tiers, tier)
+		rest = others
+	}
+	return append(tiers, priorityTier{Queries: rest})
+}
+
+// inventoryObjectTypes are the object types collected without performance counters, which can be prioritized too
+var inventoryObjectTypes = []string{"VirtualMachine", "HostSystem", "ClusterComputeResource", "ResourcePool", "Datastore", "StoragePod", "DistributedVirtualPortgroup"}
+
+// canonicalObjectType returns the vSphere spelling of an object type named case-insensitively
+func canonicalObjectType(objectType string) string {
+	for _, known := range inventoryObjectTypes {
+		if strings.EqualFold(known, objectType) {
+			return known
+		}
+	}
+	return objectType
+}
+
+// limitPoints applies MaxPointsPerCycle to a write, given the number of points of the cycle already written.
+// It returns the points to write, or false when the write is skipped.
+func (config Configuration) limitPoints(points []*influxclient.Point, written int, hostname string) ([]*influxclient.Point, bool) {
+	if config.MaxPointsPerCycle <= 0 || written+len(points) <= config.MaxPointsPerCycle {
+		return points, true
+	}
+	errlog.Println("WARNING: vcenter ", hostname, " produced ", written+len(points), " points, more than MaxPointsPerCycle ", config.MaxPointsPerCycle)
+	if config.MaxPointsAction == "skip" {
+		errlog.Println("Skipping the write of vcenter: ", hostname)
+		return nil, false
+	}
+	errlog.Println("Truncating the write of vcenter: ", hostname)
+	if written >= config.MaxPointsPerCycle {
+		return points[:0], true
+	}
+	return points[:config.MaxPointsPerCycle-written], true
+}
+
+// estimatePoints returns an upper bound of the points built from the performance results
+func estimatePoints(results []types.BasePerfEntityMetricBase) int {
+	count := 0
+	for _, base := range results {
+		if pem, ok := base.(*types.PerfEntityMetric); ok {
+			count += 1 + len(pem.Value)
+		}
+	}
+	return count
+}
+
+// limitRefs keeps at most the first limit references
+func limitRefs(refs []types.ManagedObjectReference, limit int) []types.ManagedObjectReference {
+	if len(refs) > limit {
+		return refs[:limit]
+	}
+	return refs
+}
+
+// stripName removes the configured domain suffix and NameStripRegex matches from a vCenter or entity name
+func (config Configuration) stripName(name string) string {
+	name = strings.TrimSuffix(name, config.Domain)
+	if config.nameStrip != nil {
+		name = config.nameStrip.ReplaceAllString(name, "")
+	}
+	return name
+}
+
+// tagSetKey returns a stable key identifying a set of tags
+func tagSetKey(tags map[string]string) string {
+	pairs := []string{}
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// unique returns the strings without duplicates, keeping the first occurrence order
+func unique(values []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// roundFields rounds the float fields to their metric's decimal places, or to the global ones.
+// Integer fields are left untouched.
+func roundFields(fields map[string]interface{}, fieldDecimals map[string]int, decimals *int) {
+	for key, value := range fields {
+		f, ok := value.(float64)
+		if !ok {
+			continue
+		}
+		if places, ok := fieldDecimals[key]; ok {
+			fields[key] = round(f, places)
+		} else if decimals != nil {
+			fields[key] = round(f, *decimals)
+		}
+	}
+}
+
+// round rounds a float to the given decimal places, halves are rounded away from zero
+func round(f float64, places int) float64 {
+	shift := math.Pow(10, float64(places))
+	if f < 0 {
+		return -math.Floor(-f*shift+.5) / shift
+	}
+	return math.Floor(f*shift+.5) / shift
+}
+
+// reducers aggregate the samples of a series into a single value
+var reducers = map[string]func(...int64) int64{
+	"average":   average,
+	"maximum":   max,
+	"minimum":   min,
+	"latest":    latest,
+	"summation": sum,
+}
+
+// reducer returns the reducer of a metric, configured for the metric or its rollup and defaulting to the rollup itself
+func (config Configuration) reducer(metricName string) string {
+	rollup := metricName[strings.LastIndex(metricName, ".")+1:]
+	if reducer, ok := config.Rollups[metricName]; ok {
+		return reducer
+	}
+	if reducer, ok := config.Rollups[rollup]; ok {
+		return reducer
+	}
+	return rollup
+}
+
+// validSamples counts the samples holding a value, vCenter reports missing samples as -1
+func validSamples(n []int64) int {
+	count := 0
+	for _, i := range n {
+		if i >= 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// cycleTime returns the start of the current interval, or of the current minute without interval
+func (config Configuration) cycleTime() time.Time {
+	interval := time.Minute
+	if config.Interval > 0 {
+		interval = time.Duration(config.Interval) * time.Second
+	}
+	return time.Now().Truncate(interval)
+}
+
+// alignPoints returns the points with the given timestamp
+func alignPoints(points []*influxclient.Point, timestamp time.Time) []*influxclient.Point {
+	aligned := make([]*influxclient.Point, 0, len(points))
+	for _, pt := range points {
+		// Events keep the time they happened at
+		if pt.Name() == "events" {
+			aligned = append(aligned, pt)
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		alignedPoint, err := influxclient.NewPoint(pt.Name(), pt.Tags(), fields, timestamp)
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		aligned = append(aligned, alignedPoint)
+	}
+	return aligned
+}
+
+// rewriteTags returns the points with their tag values rewritten, only rebuilding the points with a changed tag.
+// onRewrite, if set, is called with every rewritten value.
+func rewriteTags(points []*influxclient.Point, rewrites map[string][]TagValueRewrite, onRewrite func(key, original, value string)) []*influxclient.Point {
+	rewritten := make([]*influxclient.Point, 0, len(points))
+	for _, pt := range points {
+		tags := pt.Tags()
+		changed := false
+		for key, rules := range rewrites {
+			value, ok := tags[key]
+			if !ok {
+				continue
+			}
+			for _, rule := range rules {
+				value = rule.pattern.ReplaceAllString(value, rule.Replacement)
+			}
+			if value != tags[key] {
+				if onRewrite != nil {
+					onRewrite(key, tags[key], value)
+				}
+				tags[key] = value
+				changed = true
+			}
+		}
+		if !changed {
+			rewritten = append(rewritten, pt)
+			continue
+		}
+		fields, err := pt.Fields()
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		rewrittenPoint, err := influxclient.NewPoint(pt.Name(), tags, fields, pt.Time())
+		if err != nil {
+			errlog.Println(err)
+			continue
+		}
+		rewritten = append(rewritten, rewrittenPoint)
+	}
+	return rewritten
+}
+
+// countCounters returns the number of distinct counters of the metric ids
+func countCounters(metricIds []types.PerfMetricId) int {
+	counters := make(map[int32]bool)
+	for _, metricID := range metricIds {
+		counters[metricID.CounterId] = true
+	}
+	return len(counters)
+}
+
+// countSeriesCounters returns the number of distinct counters of the series
+func countSeriesCounters(series []types.BasePerfMetricSeries) int {
+	counters := make(map[int32]bool)
+	for _, serie := range series {
+		counters[serie.GetPerfMetricSeries().Id.CounterId] = true
+	}
+	return len(counters)
+}
+
+// entityMetrics returns the entities of the query results in the default encoding, counting the others by type
+// in unexpected so they are skipped rather than misread
+func entityMetrics(results []types.BasePerfEntityMetricBase, unexpected map[string]int) []*types.PerfEntityMetric {
+	entities := make([]*types.PerfEntityMetric, 0, len(results))
+	for _, base := range results {
+		switch pem := base.(type) {
+		case *types.PerfEntityMetric:
+			entities = append(entities, pem)
+		default:
+			unexpected[fmt.Sprintf("%T", base)]++
+		}
+	}
+	return entities
+}
+
+// intSeries returns the integer series of an entity, counting the series of other types in unexpected
+func intSeries(series []types.BasePerfMetricSeries, unexpected map[string]int) []*types.PerfMetricIntSeries {
+	ints := make([]*types.PerfMetricIntSeries, 0, len(series))
+	for _, base := range series {
+		switch serie := base.(type) {
+		case *types.PerfMetricIntSeries:
+			ints = append(ints, serie)
+		default:
+			unexpected[fmt.Sprintf("%T", base)]++
+		}
+	}
+	return ints
+}
+
+// percent returns used as a percentage of total, or 0 when total is 0
+func percent(used int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) * 100 / float64(total)
+}
+
+func latest(n ...int64) int64 {
+	return n[len(n)-1]
+}
 
 func min(n ...int64) int64 {
 	var min int64 = -1
@@ -675,53 +3028,537 @@ func average(n ...int64) int64 {
 	return int64(math.Floor(favg + .5))
 }
 
-func queryVCenter(vcenter VCenter, config Configuration, InfluxDBClient influxclient.Client) {
+// rollupSuffixes are the short field suffixes of the rollups, used with RollupSuffixes
+var rollupSuffixes = map[string]string{
+	"average":   "avg",
+	"maximum":   "max",
+	"minimum":   "min",
+	"summation": "sum",
+	"latest":    "latest",
+}
+
+// fieldName returns the field of a lowercased metric name, ending with the short suffix of its rollup with RollupSuffixes
+func (config Configuration) fieldName(metricName string) string {
+	if config.RollupSuffixes {
+		dot := strings.LastIndex(metricName, ".")
+		if suffix, ok := rollupSuffixes[metricName[dot+1:]]; ok {
+			metricName = metricName[:dot+1] + suffix
+		}
+	}
+	return strings.Replace(metricName, ".", "_", -1)
+}
+
+// signedReducers reduce the samples of the metrics allowing negative values, once the missing samples are removed
+var signedReducers = map[string]func(...int64) int64{
+	"average":   signedAverage,
+	"maximum":   signedMax,
+	"minimum":   signedMin,
+	"latest":    latest,
+	"summation": signedSum,
+}
+
+// presentSamples returns the samples without the missing ones, which vCenter reports as -1
+func presentSamples(n []int64) []int64 {
+	present := make([]int64, 0, len(n))
+	for _, i := range n {
+		if i != -1 {
+			present = append(present, i)
+		}
+	}
+	return present
+}
+
+// downsample averages the samples by buckets of factor consecutive samples. The missing samples are left out of the
+// averages and a bucket without any sample is missing, unless the missing samples were already removed with signed.
+func downsample(n []int64, factor int, signed bool) []int64 {
+	buckets := make([]int64, 0, (len(n)+factor-1)/factor)
+	for start := 0; start < len(n); start += factor {
+		end := start + factor
+		if end > len(n) {
+			end = len(n)
+		}
+		if signed {
+			buckets = append(buckets, signedAverage(n[start:end]...))
+		} else if validSamples(n[start:end]) > 0 {
+			buckets = append(buckets, average(n[start:end]...))
+		} else {
+			buckets = append(buckets, -1)
+		}
+	}
+	return buckets
+}
+
+func signedMin(n ...int64) int64 {
+	min := n[0]
+	for _, i := range n[1:] {
+		if i < min {
+			min = i
+		}
+	}
+	return min
+}
+
+func signedMax(n ...int64) int64 {
+	max := n[0]
+	for _, i := range n[1:] {
+		if i > max {
+			max = i
+		}
+	}
+	return max
+}
+
+func signedSum(n ...int64) int64 {
+	var total int64
+	for _, i := range n {
+		total += i
+	}
+	return total
+}
+
+func signedAverage(n ...int64) int64 {
+	favg := float64(signedSum(n...)) / float64(len(n))
+	return int64(math.Floor(favg + .5))
+}
+
+// describeJSONError adds the line, column and offending line of the configuration to a decoding error
+func describeJSONError(content []byte, err error) string {
+	var offset int64
+	switch jsonErr := err.(type) {
+	case *json.SyntaxError:
+		offset = jsonErr.Offset
+	case *json.UnmarshalTypeError:
+		offset = jsonErr.Offset
+	default:
+		return err.Error()
+	}
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+
+	line := 1 + strings.Count(string(content[:offset]), "\n")
+	lineStart := strings.LastIndex(string(content[:offset]), "\n") + 1
+	column := int(offset) - lineStart
+	lineEnd := strings.Index(string(content[lineStart:]), "\n")
+	if lineEnd == -1 {
+		lineEnd = len(content) - lineStart
+	}
+	snippet := strings.TrimSpace(string(content[lineStart : lineStart+lineEnd]))
+	return fmt.Sprintf("%s at line %d, column %d: %s", err, line, column, snippet)
+}
+
+// readPasswordFile returns the password stored in a secrets file without surrounding whitespace
+func readPasswordFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// ProxyFunc returns the proxy InfluxDB is reached through, the one of the HTTP_PROXY and HTTPS_PROXY variables by default
+func (influxdb InfluxDB) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if influxdb.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(influxdb.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// TLSConfig returns the TLS configuration authenticating to InfluxDB with a client certificate, if any
+func (influxdb InfluxDB) TLSConfig() (*tls.Config, error) {
+	if influxdb.ClientCertFile == "" && influxdb.ClientKeyFile == "" && influxdb.CAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if influxdb.ClientCertFile != "" || influxdb.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(influxdb.ClientCertFile, influxdb.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if influxdb.CAFile != "" {
+		ca, err := ioutil.ReadFile(influxdb.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", influxdb.CAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// queryVCenter collects a vCenter, retrying failed collections, and returns the error of the last attempt
+func queryVCenter(vcenter *VCenter, config Configuration, output Output) error {
+	// Refresh the metric keys periodically to follow counter changes after vCenter upgrades
+	if config.CounterRefreshCycles > 0 && vcenter.cycle > 0 && vcenter.cycle%config.CounterRefreshCycles == 0 {
+		stdlog.Println("Refreshing performance counters of vcenter: ", vcenter.Hostname)
+		vcenter.Init(config)
+	} else if vcenter.initFailed {
+		stdlog.Println("Retrying to get the performance counters of vcenter: ", vcenter.Hostname)
+		vcenter.Init(config)
+	}
+
 	stdlog.Println("Querying vcenter")
-	vcenter.Query(config, InfluxDBClient)
+	err := vcenter.Query(config, output)
+	// Retry the whole collection on transient failures such as a vCenter failover, write failures are not retried
+	for retry := 0; err != nil && err != errEmptyCollection && !isWriteError(err) && retry < config.CycleRetries; retry++ {
+		delay := 10
+		if config.CycleRetryDelay > 0 {
+			delay = config.CycleRetryDelay
+		}
+		stdlog.Println("Retrying the collection of vcenter: ", vcenter.Hostname, " in ", delay, " seconds")
+		time.Sleep(time.Duration(delay) * time.Second)
+		err = vcenter.Query(config, output)
+	}
+	vcenter.cycle++
+	return err
 }
 
 func main() {
 	flag.BoolVar(&debug, "debug", false, "Debug mode")
+	var daemon = flag.Bool("daemon", false, "Run continuously, collecting every configured interval")
+	var once = flag.Bool("once", false, "Run a single collection cycle even with -daemon")
 	var cfgFile = flag.String("config", "/etc/"+path.Base(os.Args[0])+".json", "Config file to use. Default is /etc/"+path.Base(os.Args[0])+".json")
+	var logFile = flag.String("log-file", "", "Write logs to this file instead of stdout/stderr")
+	var logMaxSize = flag.Int("log-max-size", 100, "Size in MB after which the log file is rotated")
+	var logMaxBackups = flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+	var startupDelay = flag.Int("startup-delay", 0, "Seconds to wait before the first collection")
+	var jitter = flag.Int("jitter", 0, "Wait a random number of seconds up to this one before each collection, to stagger collectors sharing vcenters")
+	var traceSoap = flag.String("trace-soap", "", "Write the SOAP requests and responses exchanged with the vcenters to this file, with credentials redacted")
 	flag.Parse()
 
-	stdlog = log.New(os.Stdout, "", log.Ldate|log.Ltime)
-	errlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+	// Mask the secrets of every log line, whatever logs it
+	stdlog = log.New(NewSecretMasker(os.Stdout), "", log.Ldate|log.Ltime)
+	errlog = log.New(NewSecretMasker(os.Stderr), "", log.Ldate|log.Ltime)
+
+	if *logFile != "" {
+		rotating, err := OpenRotatingFile(*logFile, int64(*logMaxSize)*1024*1024, *logMaxBackups)
+		if err != nil {
+			errlog.Println("Could not open log file", *logFile)
+			errlog.Fatalln(err)
+		}
+		defer rotating.Close()
+		stdlog = log.New(NewSecretMasker(rotating), "", log.Ldate|log.Ltime)
+		errlog = log.New(NewSecretMasker(rotating), "", log.Ldate|log.Ltime)
+	}
 
 	stdlog.Println("Starting :", path.Base(os.Args[0]))
 
+	// Trace the SOAP exchanges through the debug hooks of govmomi, before any client is created
+	if *traceSoap != "" {
+		trace, err := OpenSoapTrace(*traceSoap)
+		if err != nil {
+			errlog.Println("Could not open SOAP trace file", *traceSoap)
+			errlog.Fatalln(err)
+		}
+		defer trace.Close()
+		govmomidebug.SetProvider(trace)
+	}
+
 	// read the configuration
-	file, err := os.Open(*cfgFile)
+	content, err := ioutil.ReadFile(*cfgFile)
 	if err != nil {
 		errlog.Println("Could not open configuration file", *cfgFile)
 		errlog.Fatalln(err)
 	}
 
-	jsondec := json.NewDecoder(file)
 	config := Configuration{}
-	err = jsondec.Decode(&config)
+	err = json.Unmarshal(content, &config)
 	if err != nil {
 		errlog.Println("Could not decode configuration file", *cfgFile)
+		errlog.Fatalln(describeJSONError(content, err))
+	}
+	addMaskedSecret(configSecrets(config)...)
+
+	if config.NameStripRegex != "" {
+		config.nameStrip, err = regexp.Compile(config.NameStripRegex)
+		if err != nil {
+			errlog.Println("Could not compile NameStripRegex", config.NameStripRegex)
+			errlog.Fatalln(err)
+		}
+	}
+
+	if keep := config.InstanceCap.Keep; keep != "" && keep != "first" && keep != "top" {
+		errlog.Fatalln("Unknown InstanceCap Keep: ", keep, ", expected first or top")
+	}
+	if rest := config.InstanceCap.Rest; rest != "" && rest != "drop" && rest != "other" {
+		errlog.Fatalln("Unknown InstanceCap Rest: ", rest, ", expected drop or other")
+	}
+
+	for key, rules := range config.TagValueRewrites {
+		for i := range rules {
+			rules[i].pattern, err = regexp.Compile(rules[i].Pattern)
+			if err != nil {
+				errlog.Println("Could not compile the TagValueRewrites pattern", rules[i].Pattern, "of tag", key)
+				errlog.Fatalln(err)
+			}
+		}
+	}
+
+	config.cardinalityRules, err = compileCardinalityReduction(config.CardinalityReduction)
+	if err != nil {
+		errlog.Println("Could not compile the CardinalityReduction patterns")
 		errlog.Fatalln(err)
 	}
 
+	// Check the configured reducers, matching metrics case-insensitively
+	rollups := make(map[string]string)
+	for metric, reducer := range config.Rollups {
+		if _, ok := reducers[reducer]; !ok {
+			errlog.Fatalln("Unknown reducer ", reducer, " for rollup: ", metric)
+		}
+		rollups[strings.ToLower(metric)] = reducer
+	}
+	config.Rollups = rollups
+
+	// Check the sampling intervals requested from the vCenters
+	for i, vcenter := range config.VCenters {
+		// The first address names the vCenter when only fallback addresses are configured
+		if vcenter.Hostname == "" && len(vcenter.Hostnames) > 0 {
+			vcenter.Hostname = vcenter.Hostnames[0]
+		}
+		if len(vcenter.addresses()) == 0 {
+			errlog.Fatalln("vcenter ", i+1, " has no Hostname or Hostnames")
+		}
+		switch vcenter.IntervalID {
+		case 0, 20, 300, 1800, 7200, 86400:
+		default:
+			errlog.Fatalln("Invalid IntervalID ", vcenter.IntervalID, " for vcenter: ", vcenter.Hostname)
+		}
+		window := time.Duration(config.Interval+config.OverlapSeconds) * time.Second
+		if (vcenter.IntervalID == 0 || vcenter.IntervalID == 20) && window > realtimeRetention {
+			errlog.Println("Warning: the query window of ", window, " exceeds the ", realtimeRetention, " of real-time samples kept by vcenter: ", vcenter.Hostname, ", only the last hour is queried, set IntervalID to 300 to query historical samples")
+		}
+	}
+
+	for _, processor := range config.Processors {
+		if _, ok := pointProcessors[processor]; !ok {
+			errlog.Fatalln("Unknown processor: ", processor, ", expected one of ", processorNames())
+		}
+	}
+
+	if config.PropertyFaults != "" && config.PropertyFaults != "skip" && config.PropertyFaults != "fail" {
+		errlog.Fatalln("Unknown PropertyFaults: ", config.PropertyFaults, ", expected skip or fail")
+	}
+
+	if config.MaxSample < 0 {
+		errlog.Fatalln("Invalid MaxSample ", config.MaxSample, ", expected a positive number of samples")
+	}
+
+	// Add the built-in metric presets
+	for _, preset := range config.Presets {
+		metrics, ok := metricPresets[preset]
+		if !ok {
+			errlog.Fatalln("Unknown metric preset: ", preset)
+		}
+		config.Metrics = append(config.Metrics, metrics...)
+	}
+
+	// Object types that can be prioritized, the inventory ones and the ones of the global and per vCenter metrics
+	objectTypes := make(map[string]bool)
+	for _, objectType := range inventoryObjectTypes {
+		objectTypes[strings.ToLower(objectType)] = true
+	}
+	metrics := append([]Metric{}, config.Metrics...)
+	for _, vcenter := range config.VCenters {
+		metrics = append(metrics, vcenter.Metrics...)
+	}
+	for _, metric := range metrics {
+		for _, objectType := range metric.ObjectType {
+			objectTypes[strings.ToLower(objectType)] = true
+		}
+		for _, metricdef := range metric.Definition {
+			if metricdef.Downsample < 0 {
+				errlog.Fatalln("Invalid Downsample ", metricdef.Downsample, " for metric: ", metricdef.Metric)
+			}
+		}
+	}
+	for _, objectType := range config.Priorities {
+		if !objectTypes[strings.ToLower(objectType)] {
+			errlog.Fatalln("Unknown object type ", objectType, " in Priorities")
+		}
+	}
+
+	// Fetch the vCenter credentials from Vault at login when it is configured
+	if config.Vault.Path != "" {
+		vault := NewVaultCredentials(config.Vault)
+		for _, vcenter := range config.VCenters {
+			vcenter.credentials = vault
+		}
+	}
+
+	// Read the InfluxDB password from its secrets file when it is not set inline
+	if config.InfluxDB.Password == "" && config.InfluxDB.PasswordFile != "" {
+		config.InfluxDB.Password, err = readPasswordFile(config.InfluxDB.PasswordFile)
+		if err != nil {
+			errlog.Println("Could not read password file for InfluxDB")
+			errlog.Fatalln(err)
+		}
+		addMaskedSecret(config.InfluxDB.Password)
+	}
+
+	if config.AuditLog != "" {
+		config.audit, err = OpenAuditLog(config.AuditLog)
+		if err != nil {
+			errlog.Println("Could not open audit log", config.AuditLog)
+			errlog.Fatalln(err)
+		}
+		defer config.audit.Close()
+	}
+
+	// Fingerprint the configuration before the vCenters add their metric groups to it
+	config.fingerprint = configFingerprint(config)
+
 	for _, vcenter := range config.VCenters {
 		vcenter.Init(config)
 	}
+	config.VCenters = uniqueVCenters(config.VCenters)
 
-	InfluxDBClient, err := influxclient.NewHTTPClient(influxclient.HTTPConfig{
-		Addr:     config.InfluxDB.Hostname,
-		Username: config.InfluxDB.Username,
-		Password: config.InfluxDB.Password,
-	})
+	// Serve the metrics to Prometheus instead of writing them to the outputs
+	if config.Exporter.ListenAddress != "" {
+		serveExporter(config)
+		return
+	}
+
+	influxDBOutput, err := NewInfluxDBOutput(config.InfluxDB)
 	if err != nil {
 		errlog.Println("Could not connect to InfluxDB")
+		errlog.Println(err)
+		os.Exit(exitInfluxDBError)
+	}
+
+	if config.UsesInfluxDB() {
+		version, err := influxDBOutput.Ping(5 * time.Second)
+		if err != nil {
+			errlog.Println("Could not ping InfluxDB at ", config.InfluxDB.Hostname)
+			if !config.InfluxDB.WarnOnPingFailure {
+				errlog.Println(err)
+				os.Exit(exitInfluxDBError)
+			}
+			errlog.Println("Error: ", err)
+		} else {
+			stdlog.Println("Successfully connected to InfluxDB version ", version)
+		}
+	}
+
+	var outputs Output
+	outputs, err = NewOutputs(config, influxDBOutput)
+	if err != nil {
+		errlog.Println("Could not create outputs")
 		errlog.Fatalln(err)
 	}
+	if config.InfluxDB.MaxConcurrentWrites > 0 {
+		outputs = NewLimitedOutput(outputs, config.InfluxDB.MaxConcurrentWrites)
+	}
+	if config.InfluxDB.FlushInterval > 0 || config.InfluxDB.FlushSize > 0 {
+		drainTimeout := 30 * time.Second
+		if config.InfluxDB.DrainTimeout > 0 {
+			drainTimeout = time.Duration(config.InfluxDB.DrainTimeout) * time.Second
+		}
+		if config.InfluxDB.DropPolicy != "" && config.InfluxDB.DropPolicy != "oldest" && config.InfluxDB.DropPolicy != "newest" {
+			errlog.Fatalln("Unknown DropPolicy: ", config.InfluxDB.DropPolicy, ", expected oldest or newest")
+		}
+		outputs = NewBufferedOutput(outputs, time.Duration(config.InfluxDB.FlushInterval)*time.Second, config.InfluxDB.FlushSize, config.InfluxDB.MaxBufferSize, config.InfluxDB.DropPolicy, drainTimeout)
+	}
+	defer outputs.Close()
 
-	stdlog.Println("Successfully connected to Influx")
+	// Stagger the first collection of collectors started together
+	rand.Seed(time.Now().UnixNano() + int64(os.Getpid()))
+	if delay := time.Duration(*startupDelay)*time.Second + randomDelay(*jitter); delay > 0 {
+		stdlog.Println("Waiting ", delay, " before the first collection")
+		time.Sleep(delay)
+	}
 
-	for _, vcenter := range config.VCenters {
-		queryVCenter(*vcenter, config, InfluxDBClient)
+	if *once || !*daemon {
+		writeConfigFingerprint(config, outputs)
+		failed, writeFailed, empty := 0, 0, false
+		for _, vcenter := range config.VCenters {
+			err := queryVCenter(vcenter, config, outputs)
+			if err == errEmptyCollection {
+				empty = true
+			} else if isWriteError(err) {
+				writeFailed++
+			} else if err != nil {
+				failed++
+			}
+			vcenter.Close()
+		}
+		code := exitSuccess
+		if writeFailed > 0 {
+			errlog.Println("Writing to the outputs failed for ", writeFailed, " of ", len(config.VCenters), " vcenters")
+			code = exitInfluxDBError
+		} else if failed > 0 && failed == len(config.VCenters) {
+			errlog.Println("Collection failed on every vcenter")
+			code = exitAllFailed
+		} else if failed > 0 {
+			errlog.Println("Collection failed on ", failed, " of ", len(config.VCenters), " vcenters")
+			code = exitPartialFailed
+		} else if empty {
+			errlog.Println("Collection produced too few points on at least one vcenter")
+			code = exitTooFewPoints
+		}
+		// os.Exit skips the deferred calls, so flush the outputs first, buffered points may still fail to be written
+		err := outputs.Close()
+		if err != nil && code == exitSuccess {
+			errlog.Println("Could not flush the outputs: ", err)
+			code = exitInfluxDBError
+		}
+		os.Exit(code)
+	}
+
+	if config.Interval <= 0 {
+		errlog.Fatalln("Interval must be greater than 0 in daemon mode")
+	}
+	// Stop collecting on termination, the deferred closes then drain the outputs
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	shutdown := func(sig os.Signal) {
+		stdlog.Println("Received ", sig, ", shutting down")
+		for _, vcenter := range config.VCenters {
+			vcenter.Close()
+		}
+	}
+	jitterSeconds := *jitter
+	if jitterSeconds >= config.Interval {
+		jitterSeconds = config.Interval / 2
+	}
+
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		writeConfigFingerprint(config, outputs)
+		for _, vcenter := range config.VCenters {
+			queryVCenter(vcenter, config, outputs)
+		}
+		select {
+		case <-ticker.C:
+		case sig := <-signals:
+			shutdown(sig)
+			return
+		}
+		// Jitter the ticks, within the interval, so the collectors do not query shared vcenters at the same instant
+		select {
+		case <-time.After(randomDelay(jitterSeconds)):
+		case sig := <-signals:
+			shutdown(sig)
+			return
+		}
+	}
+}
+
+// randomDelay returns a random delay up to the given number of seconds
+func randomDelay(seconds int) time.Duration {
+	if seconds <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(seconds) * int64(time.Second)))
 }
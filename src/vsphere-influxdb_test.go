@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vim25/xml"
+	"golang.org/x/net/context"
+)
+
+func TestMain(m *testing.M) {
+	// The loggers are created by main
+	stdlog = log.New(ioutil.Discard, "", 0)
+	errlog = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+func TestVMHostName(t *testing.T) {
+	host := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	unknown := types.ManagedObjectReference{Type: "HostSystem", Value: "host-2"}
+	hostSummary := map[types.ManagedObjectReference]map[string]string{
+		host: {"name": "esx1.domain.com"},
+	}
+
+	cases := []struct {
+		name     string
+		host     *types.ManagedObjectReference
+		expected string
+	}{
+		{"nil host", nil, ""},
+		{"unknown host", &unknown, ""},
+		{"known host", &host, "esx1.domain.com"},
+	}
+	for _, c := range cases {
+		var vm mo.VirtualMachine
+		vm.Summary.Runtime.Host = c.host
+		if name := vmHostName(vm, hostSummary); name != c.expected {
+			t.Errorf("%s: vmHostName = %q, expected %q", c.name, name, c.expected)
+		}
+	}
+}
+
+func TestIntSeriesSkipsUnexpectedTypes(t *testing.T) {
+	cpu := &types.PerfMetricIntSeries{PerfMetricSeries: types.PerfMetricSeries{Id: types.PerfMetricId{CounterId: 2}}, Value: []int64{10, 20}}
+	csv := &types.PerfMetricSeriesCSV{PerfMetricSeries: types.PerfMetricSeries{Id: types.PerfMetricId{CounterId: 6}}, Value: "10,20"}
+	mem := &types.PerfMetricIntSeries{PerfMetricSeries: types.PerfMetricSeries{Id: types.PerfMetricId{CounterId: 24}}, Value: []int64{30}}
+	unexpected := make(map[string]int)
+
+	series := intSeries([]types.BasePerfMetricSeries{cpu, csv, &types.PerfMetricSeries{}, mem}, unexpected)
+	if len(series) != 2 || series[0] != cpu || series[1] != mem {
+		t.Errorf("intSeries = %v, expected the two integer series", series)
+	}
+	expected := map[string]int{"*types.PerfMetricSeriesCSV": 1, "*types.PerfMetricSeries": 1}
+	if len(unexpected) != len(expected) {
+		t.Errorf("unexpected = %v, expected %v", unexpected, expected)
+	}
+	for seriesType, count := range expected {
+		if unexpected[seriesType] != count {
+			t.Errorf("unexpected[%s] = %d, expected %d", seriesType, unexpected[seriesType], count)
+		}
+	}
+}
+
+func TestEntityMetricsSkipsUnexpectedTypes(t *testing.T) {
+	vm := &types.PerfEntityMetric{PerfEntityMetricBase: types.PerfEntityMetricBase{Entity: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}}}
+	csv := &types.PerfEntityMetricCSV{PerfEntityMetricBase: types.PerfEntityMetricBase{Entity: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}}}
+	unexpected := make(map[string]int)
+
+	entities := entityMetrics([]types.BasePerfEntityMetricBase{csv, vm}, unexpected)
+	if len(entities) != 1 || entities[0] != vm {
+		t.Errorf("entityMetrics = %v, expected the default encoded entity", entities)
+	}
+	if unexpected["*types.PerfEntityMetricCSV"] != 1 || len(unexpected) != 1 {
+		t.Errorf("unexpected = %v, expected one *types.PerfEntityMetricCSV", unexpected)
+	}
+}
+
+// soapEnvelope wraps the body of a response of the fake vCenter
+func soapEnvelope(body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<soapenv:Body>` + body + `</soapenv:Body></soapenv:Envelope>`
+}
+
+// fakeVCenter answers the service content and login requests of a vCenter of apiVersion, faulting on newer API
+// versions if rejectNewer is set, and records the version of every request
+func fakeVCenter(apiVersion string, rejectNewer bool, versions *[]string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := strings.TrimPrefix(r.Header.Get("SOAPAction"), "urn:vim25/")
+		*versions = append(*versions, version)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		if rejectNewer && versionLess(apiVersion, version) {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, soapEnvelope(`<soapenv:Fault><faultcode>ServerFaultCode</faultcode>`+
+				`<faultstring>Unsupported version URI "urn:vim25/`+version+`"</faultstring></soapenv:Fault>`))
+			return
+		}
+		switch {
+		case bytes.Contains(body, []byte("RetrieveServiceContent")):
+			fmt.Fprint(w, soapEnvelope(`<RetrieveServiceContentResponse xmlns="urn:vim25"><returnval>`+
+				`<rootFolder type="Folder">group-d1</rootFolder>`+
+				`<propertyCollector type="PropertyCollector">propertyCollector</propertyCollector>`+
+				`<about><name>VMware vCenter Server</name><fullName>VMware vCenter Server `+apiVersion+`</fullName>`+
+				`<vendor>VMware, Inc.</vendor><version>`+apiVersion+`</version><build>1</build><osType>linux-x64</osType>`+
+				`<productLineId>vpx</productLineId><apiType>VirtualCenter</apiType><apiVersion>`+apiVersion+`</apiVersion></about>`+
+				`<sessionManager type="SessionManager">SessionManager</sessionManager>`+
+				`</returnval></RetrieveServiceContentResponse>`))
+		case bytes.Contains(body, []byte("Login")):
+			fmt.Fprint(w, soapEnvelope(`<LoginResponse xmlns="urn:vim25"><returnval>`+
+				`<key>session-1</key><userName>user</userName><fullName>user</fullName>`+
+				`<loginTime>2017-01-01T00:00:00Z</loginTime><lastActiveTime>2017-01-01T00:00:00Z</lastActiveTime>`+
+				`<locale>en</locale><messageLocale>en</messageLocale><extensionSession>false</extensionSession>`+
+				`</returnval></LoginResponse>`))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+}
+
+func TestConnectToDowngradesOnVersionFault(t *testing.T) {
+	var versions []string
+	server := fakeVCenter(soap.DefaultMinVimVersion, true, &versions)
+	defer server.Close()
+
+	vcenter := &VCenter{Hostname: server.Listener.Addr().String()}
+	client, err := vcenter.connectTo(context.Background(), vcenter.Hostname, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) < 2 || versions[0] != soap.DefaultVimVersion || versions[1] != soap.DefaultMinVimVersion {
+		t.Errorf("request versions = %v, expected %s then %s", versions, soap.DefaultVimVersion, soap.DefaultMinVimVersion)
+	}
+	if version := client.Client.Client.Version; version != soap.DefaultMinVimVersion {
+		t.Errorf("client version = %s, expected %s", version, soap.DefaultMinVimVersion)
+	}
+}
+
+func TestConnectToPinnedVersionDoesNotRetry(t *testing.T) {
+	var versions []string
+	server := fakeVCenter("5.0", true, &versions)
+	defer server.Close()
+
+	vcenter := &VCenter{Hostname: server.Listener.Addr().String(), ApiVersion: "6.0"}
+	if _, err := vcenter.connectTo(context.Background(), vcenter.Hostname, "user", "password"); err == nil {
+		t.Fatal("connectTo succeeded with a version the vCenter rejects")
+	}
+	if len(versions) != 1 || versions[0] != "6.0" {
+		t.Errorf("request versions = %v, expected only the pinned 6.0", versions)
+	}
+}
+
+func TestConnectToUsesOlderVersion(t *testing.T) {
+	var versions []string
+	server := fakeVCenter("6.0", false, &versions)
+	defer server.Close()
+
+	vcenter := &VCenter{Hostname: server.Listener.Addr().String()}
+	client, err := vcenter.connectTo(context.Background(), vcenter.Hostname, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := client.Client.Client.Version; version != "6.0" {
+		t.Errorf("client version = %s, expected the 6.0 of the vCenter", version)
+	}
+}
+
+func TestStripName(t *testing.T) {
+	cases := []struct {
+		name     string
+		domain   string
+		regex    string
+		input    string
+		expected string
+	}{
+		{"suffix", ".domain.com", "", "esx1.domain.com", "esx1"},
+		{"no suffix", ".domain.com", "", "esx1", "esx1"},
+		{"suffix only once", ".domain.com", "", "esx1.domain.com.domain.com", "esx1.domain.com"},
+		{"substring kept", ".domain.com", "", "vm.domain.com-backup", "vm.domain.com-backup"},
+		{"no domain", "", "", "esx1.domain.com", "esx1.domain.com"},
+		{"regex anywhere", "", `-(prod|test)`, "web-prod-01", "web-01"},
+		{"regex every match", "", `-(prod|test)`, "web-prod-test", "web"},
+		{"regex suffix", "", `\.domain\.(com|net)$`, "vcenter.domain.net", "vcenter"},
+		{"regex after domain", ".domain.com", `^lab-`, "lab-esx1.domain.com", "esx1"},
+	}
+	for _, c := range cases {
+		config := Configuration{Domain: c.domain}
+		if c.regex != "" {
+			config.nameStrip = regexp.MustCompile(c.regex)
+		}
+		if name := config.stripName(c.input); name != c.expected {
+			t.Errorf("%s: stripName(%q) = %q, expected %q", c.name, c.input, name, c.expected)
+		}
+	}
+}
+
+func TestStripNameKeepsDomainInsideName(t *testing.T) {
+	// Regression: the domain was removed wherever it appeared, turning prod-example-db into prod--db
+	config := Configuration{Domain: "example"}
+	for input, expected := range map[string]string{
+		"prod-example-db": "prod-example-db",
+		"example-db":      "example-db",
+		"db.example":      "db.",
+	} {
+		if name := config.stripName(input); name != expected {
+			t.Errorf("stripName(%q) = %q, expected %q", input, name, expected)
+		}
+	}
+}
+
+func TestMetricDefinitionsPerObjectType(t *testing.T) {
+	// The same counter key configured differently for two object types, and another counter sharing nothing
+	groups := []*MetricGroup{
+		{ObjectType: "VirtualMachine", Metrics: []MetricDef{
+			{Metric: "cpu.usage.average", Key: 2, Tags: map[string]string{"source": "vm"}},
+			{Metric: "mem.usage.average", Key: 24},
+		}},
+		{ObjectType: "HostSystem", Metrics: []MetricDef{
+			{Metric: "cpu.usage.average", Key: 2, Instances: "*", Scale: 0.01},
+		}},
+		{ObjectType: "Datastore", Metrics: []MetricDef{
+			{Metric: "datastore.numberReadAveraged.average", Key: 24},
+		}},
+	}
+	metricDefs := metricDefinitions(groups)
+
+	cases := []struct {
+		objectType string
+		key        int32
+		metric     string
+		instances  string
+		scale      float64
+		tag        string
+	}{
+		{"VirtualMachine", 2, "cpu.usage.average", "", 0, "vm"},
+		{"HostSystem", 2, "cpu.usage.average", "*", 0.01, ""},
+		{"VirtualMachine", 24, "mem.usage.average", "", 0, ""},
+		{"Datastore", 24, "datastore.numberReadAveraged.average", "", 0, ""},
+	}
+	for _, c := range cases {
+		metricdef, ok := metricDefs[metricKey{ObjectType: c.objectType, Key: c.key}]
+		if !ok {
+			t.Errorf("no definition of counter %d for %s", c.key, c.objectType)
+			continue
+		}
+		if metricdef.Metric != c.metric || metricdef.Instances != c.instances || metricdef.Scale != c.scale || metricdef.Tags["source"] != c.tag {
+			t.Errorf("counter %d of %s resolved to %+v", c.key, c.objectType, metricdef)
+		}
+	}
+	if _, ok := metricDefs[metricKey{ObjectType: "Datastore", Key: 2}]; ok {
+		t.Error("counter 2 resolved for Datastore, which does not query it")
+	}
+	if len(metricDefs) != 4 {
+		t.Errorf("%d definitions, expected 4", len(metricDefs))
+	}
+}
+
+// syntheticResults returns the performance results of a large inventory of entities with series counters each
+func syntheticResults(entities int, series int) []types.BasePerfEntityMetricBase {
+	results := make([]types.BasePerfEntityMetricBase, 0, entities)
+	for i := 0; i < entities; i++ {
+		pem := &types.PerfEntityMetric{PerfEntityMetricBase: types.PerfEntityMetricBase{Entity: types.ManagedObjectReference{Type: "VirtualMachine", Value: fmt.Sprint("vm-", i)}}}
+		for j := 0; j < series; j++ {
+			pem.Value = append(pem.Value, &types.PerfMetricIntSeries{PerfMetricSeries: types.PerfMetricSeries{Id: types.PerfMetricId{CounterId: int32(j)}}, Value: []int64{1, 2, 3}})
+		}
+		results = append(results, pem)
+	}
+	return results
+}
+
+// BenchmarkCyclePoints compares adding the points of a large inventory to the batch one by one, as the collector
+// used to, with collecting them in a slice pre-sized from the performance results
+func BenchmarkCyclePoints(b *testing.B) {
+	results := syntheticResults(5000, 20)
+	pt, err := influxclient.NewPoint("vm", map[string]string{"name": "vm"}, map[string]interface{}{"usage": int64(1)}, time.Now())
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := influxclient.BatchPointsConfig{Database: "vsphere", Precision: "s"}
+
+	b.Run("AddPoint", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bp, _ := influxclient.NewBatchPoints(config)
+			for _, pem := range entityMetrics(results, map[string]int{}) {
+				bp.AddPoint(pt)
+				for range pem.Value {
+					bp.AddPoint(pt)
+				}
+			}
+		}
+	})
+	b.Run("Presized", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bp, _ := influxclient.NewBatchPoints(config)
+			points := make([]*influxclient.Point, 0, estimatePoints(results))
+			for _, pem := range entityMetrics(results, map[string]int{}) {
+				points = append(points, pt)
+				for range pem.Value {
+					points = append(points, pt)
+				}
+			}
+			bp.AddPoints(points)
+		}
+	})
+}
+
+// propertyValue returns the value of a property path, e.g. summary.runtime.host, of a managed object, or false
+// when it is unset
+func propertyValue(object interface{}, path string) (interface{}, bool) {
+	value := reflect.ValueOf(object)
+	for _, name := range strings.Split(path, ".") {
+		for value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return nil, false
+			}
+			value = value.Elem()
+		}
+		field := reflect.Value{}
+		for i := 0; i < value.NumField(); i++ {
+			tag := value.Type().Field(i).Tag
+			if strings.Split(tag.Get("mo"), ",")[0] == name || strings.Split(tag.Get("xml"), ",")[0] == name {
+				field = value.Field(i)
+				break
+			}
+		}
+		if !field.IsValid() {
+			return nil, false
+		}
+		value = field
+	}
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, false
+		}
+		value = value.Elem()
+	}
+	return value.Interface(), true
+}
+
+// vmPropertiesResponse encodes the response of the retrieval of the properties of vms as sent by the vCenter
+func vmPropertiesResponse(b *testing.B, vms int, properties []string) []byte {
+	host := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	bootTime := time.Unix(1500000000, 0)
+	var vm mo.VirtualMachine
+	vm.Summary = types.VirtualMachineSummary{
+		Vm: &types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+		Runtime: types.VirtualMachineRuntimeInfo{
+			Host: &host, ConnectionState: "connected", PowerState: "poweredOn", BootTime: &bootTime,
+			FaultToleranceState: "notConfigured", MaxCpuUsage: 4800, MaxMemoryUsage: 8192, NumMksConnections: 0,
+		},
+		Guest: &types.VirtualMachineGuestSummary{GuestId: "rhel7_64Guest", GuestFullName: "Red Hat Enterprise Linux 7 (64-bit)", ToolsStatus: "toolsOk", ToolsVersionStatus2: "guestToolsCurrent", ToolsRunningStatus: "guestToolsRunning", HostName: "vm1.domain.com", IpAddress: "10.0.0.1"},
+		Config: types.VirtualMachineConfigSummary{
+			Name: "vm1", Template: false, VmPathName: "[datastore1] vm1/vm1.vmx", MemorySizeMB: 8192, CpuReservation: 0, MemoryReservation: 0,
+			NumCpu: 2, NumEthernetCards: 1, NumVirtualDisks: 2, Uuid: "42008ab5-1234-5678-9abc-def012345678", InstanceUuid: "50008ab5-1234-5678-9abc-def012345678",
+			GuestId: "rhel7_64Guest", GuestFullName: "Red Hat Enterprise Linux 7 (64-bit)", Annotation: "Application server", Product: nil,
+		},
+		Storage: &types.VirtualMachineStorageSummary{Committed: 42949672960, Uncommitted: 10737418240, Unshared: 42949672960, Timestamp: bootTime},
+		QuickStats: types.VirtualMachineQuickStats{
+			OverallCpuUsage: 512, OverallCpuDemand: 600, GuestMemoryUsage: 2048, HostMemoryUsage: 8300, GuestHeartbeatStatus: "green",
+			DistributedCpuEntitlement: 600, DistributedMemoryEntitlement: 4096, StaticCpuEntitlement: 4800, StaticMemoryEntitlement: 8300,
+			PrivateMemory: 8192, SharedMemory: 0, SwappedMemory: 0, BalloonedMemory: 0, ConsumedOverheadMemory: 60, FtLogBandwidth: -1,
+			FtSecondaryLatency: -1, FtLatencyStatus: "gray", CompressedMemory: 0, UptimeSeconds: 3600, SsdSwappedMemory: 0,
+		},
+		OverallStatus: "green",
+	}
+
+	// The feature requirements of the CPU make up most of the runtime of a powered on vm
+	for _, feature := range []string{"SSE3", "PCLMULQDQ", "SSSE3", "FMA", "CMPXCHG16B", "PCID", "SSE41", "SSE42", "MOVBE", "POPCNT",
+		"AES", "XSAVE", "AVX", "F16C", "RDRAND", "FSGSBASE", "BMI1", "AVX2", "SMEP", "BMI2", "ENFSTRM", "INVPCID", "RDSEED",
+		"ADX", "SMAP", "CLFLUSHOPT", "XSAVEOPT", "XSAVEC", "XSAVES", "LAHF64", "ABM", "3DNPREFETCH", "NX", "PDPE1GB", "RDTSCP", "LM"} {
+		vm.Summary.Runtime.FeatureRequirement = append(vm.Summary.Runtime.FeatureRequirement, types.VirtualMachineFeatureRequirement{Key: "cpuid." + feature, FeatureName: "cpuid." + feature, Value: "Bool:Min:1"})
+	}
+
+	var res types.RetrievePropertiesResponse
+	for i := 0; i < vms; i++ {
+		content := types.ObjectContent{Obj: types.ManagedObjectReference{Type: "VirtualMachine", Value: fmt.Sprint("vm-", i)}}
+		for _, property := range properties {
+			if value, ok := propertyValue(vm, property); ok {
+				content.PropSet = append(content.PropSet, types.DynamicProperty{Name: property, Val: value})
+			}
+		}
+		res.Returnval = append(res.Returnval, content)
+	}
+	payload, err := xml.Marshal(res)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return payload
+}
+
+// BenchmarkRetrieveVMProperties compares decoding the whole summary of a large inventory of vms with decoding
+// only the summary properties in use
+func BenchmarkRetrieveVMProperties(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		properties []string
+	}{
+		{"Summary", []string{"summary"}},
+		{"SummaryProperties", vmSummaryProperties},
+	} {
+		payload := vmPropertiesResponse(b, 5000, bench.properties)
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var res types.RetrievePropertiesResponse
+				decoder := xml.NewDecoder(bytes.NewReader(payload))
+				decoder.TypeFunc = types.TypeFunc()
+				if err := decoder.Decode(&res); err != nil {
+					b.Fatal(err)
+				}
+				var vms []mo.VirtualMachine
+				if err := mo.LoadRetrievePropertiesResponse(&res, &vms); err != nil {
+					b.Fatal(err)
+				}
+				if len(vms) != 5000 || vms[4999].Summary.Runtime.Host == nil {
+					b.Fatalf("decoded %d vms", len(vms))
+				}
+			}
+		})
+	}
+}
+
+// slowOutput takes latency to write each batch, as a remote InfluxDB would
+type slowOutput struct {
+	latency time.Duration
+}
+
+func (output slowOutput) Write(bp influxclient.BatchPoints) error {
+	time.Sleep(output.latency)
+	return nil
+}
+
+func (output slowOutput) Close() error {
+	return nil
+}
+
+// BenchmarkWritePointsRouted measures writing the points of a cycle routed to 8 databases, one batch at a time
+// as before and with the batches written concurrently
+func BenchmarkWritePointsRouted(b *testing.B) {
+	config := Configuration{InfluxDB: InfluxDB{Database: "vsphere"}, MeasurementRouting: map[string]string{}}
+	points := []*influxclient.Point{}
+	for i := 0; i < 8; i++ {
+		measurement := fmt.Sprint("measurement", i)
+		config.MeasurementRouting[measurement] = fmt.Sprint("database", i)
+		for j := 0; j < 100; j++ {
+			pt, err := influxclient.NewPoint(measurement, map[string]string{"name": fmt.Sprint("vm", j)}, map[string]interface{}{"value": int64(j)}, time.Now())
+			if err != nil {
+				b.Fatal(err)
+			}
+			points = append(points, pt)
+		}
+	}
+	output := slowOutput{latency: 5 * time.Millisecond}
+
+	for _, bench := range []struct {
+		name   string
+		output Output
+	}{
+		{"Serial", NewLimitedOutput(output, 1)},
+		{"MaxConcurrentWrites4", NewLimitedOutput(output, 4)},
+		{"Concurrent", output},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := writePoints(config, bench.output, points, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTaggedObjectsCached(t *testing.T) {
+	logins := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/com/vmware/cis/session":
+			if r.Method == "POST" {
+				logins++
+			}
+			fmt.Fprint(w, `{"value": "session"}`)
+		case "/rest/com/vmware/cis/tagging/tag":
+			fmt.Fprint(w, `{"value": ["tag-1"]}`)
+		case "/rest/com/vmware/cis/tagging/tag/id:tag-1":
+			fmt.Fprint(w, `{"value": {"name": "true", "category_id": "category-1"}}`)
+		case "/rest/com/vmware/cis/tagging/tag-association/id:tag-1":
+			fmt.Fprint(w, `{"value": [{"id": "host-1", "type": "HostSystem"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vcenter := &VCenter{Hostname: server.Listener.Addr().String(), Username: "user", Password: "password"}
+	cases := []struct {
+		cycle         int
+		refreshCycles int
+		logins        int
+	}{
+		{0, 0, 1},
+		{5, 0, 1},
+		{9, 0, 1},
+		{10, 0, 2},
+		{11, 2, 2},
+		{12, 2, 3},
+	}
+	for _, c := range cases {
+		vcenter.cycle = c.cycle
+		tagged, err := vcenter.taggedObjects(TagFilter{Name: "true", RefreshCycles: c.refreshCycles})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tagged[types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}] || len(tagged) != 1 {
+			t.Errorf("cycle %d: tagged = %v, expected host-1", c.cycle, tagged)
+		}
+		if logins != c.logins {
+			t.Errorf("cycle %d: %d lookups, expected %d", c.cycle, logins, c.logins)
+		}
+	}
+}
+
+func TestSelectHosts(t *testing.T) {
+	hosts := []mo.HostSystem{}
+	for _, value := range []string{"host-1", "host-2", "host-3"} {
+		var host mo.HostSystem
+		host.Self = types.ManagedObjectReference{Type: "HostSystem", Value: value}
+		hosts = append(hosts, host)
+	}
+	refs := []types.ManagedObjectReference{hosts[2].Self, hosts[0].Self, {Type: "HostSystem", Value: "host-4"}}
+
+	selected := selectHosts(hosts, refs)
+	if len(selected) != 2 || selected[0].Self != hosts[0].Self || selected[1].Self != hosts[2].Self {
+		t.Errorf("selectHosts = %v, expected host-1 and host-3", selected)
+	}
+	if all := selectHosts(hosts, []types.ManagedObjectReference{hosts[0].Self, hosts[1].Self, hosts[2].Self}); len(all) != 3 {
+		t.Errorf("selectHosts kept %d of the 3 hosts", len(all))
+	}
+}
+
+func TestVCenterAddresses(t *testing.T) {
+	cases := []struct {
+		vcenter  VCenter
+		expected []string
+	}{
+		{VCenter{}, []string{}},
+		{VCenter{Hostnames: []string{""}}, []string{}},
+		{VCenter{Hostname: "vip"}, []string{"vip"}},
+		{VCenter{Hostname: "vip", Hostnames: []string{"node1", "vip", "", "node2"}}, []string{"vip", "node1", "node2"}},
+		{VCenter{Hostnames: []string{"node1", "node2"}}, []string{"node1", "node2"}},
+	}
+	for _, c := range cases {
+		addresses := c.vcenter.addresses()
+		if strings.Join(addresses, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("addresses of %q and %q = %q, expected %q", c.vcenter.Hostname, c.vcenter.Hostnames, addresses, c.expected)
+		}
+	}
+}
+
+func TestConnectWithoutAddresses(t *testing.T) {
+	vcenter := &VCenter{Hostnames: []string{""}, Username: "user", Password: "password"}
+	client, err := vcenter.Connect()
+	if err == nil || client != nil {
+		t.Errorf("Connect = %v, %v, expected an error", client, err)
+	}
+}
+
+// overlappedSamples returns the sample infos of the 20 second samples from first to last
+func overlappedSamples(first int, last int) ([]types.PerfSampleInfo, []int64) {
+	samples := []types.PerfSampleInfo{}
+	values := []int64{}
+	for i := first; i <= last; i++ {
+		samples = append(samples, types.PerfSampleInfo{Timestamp: time.Unix(int64(i*20), 0), Interval: 20})
+		values = append(values, int64(i))
+	}
+	return samples, values
+}
+
+func TestOverlapRecoversSamplesOfFailedWrite(t *testing.T) {
+	vm := types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+	vcenter := &VCenter{}
+
+	// A cycle builds its points from samples 1 to 3, then fails to write them
+	samples, values := overlappedSamples(1, 3)
+	if written := newSamples(values, samples, vcenter.lastSamples[vm]); len(written) != 3 {
+		t.Fatalf("first cycle kept %v, expected the 3 samples", written)
+	}
+	// The write failed, so its samples are not marked as written
+
+	// The next cycle overlaps the failed one and must return its samples again
+	samples, values = overlappedSamples(2, 5)
+	written := newSamples(values, samples, vcenter.lastSamples[vm])
+	if len(written) != 4 || written[0] != 2 {
+		t.Fatalf("cycle after a failed write kept %v, expected samples 2 to 5", written)
+	}
+	vcenter.markSamplesWritten(map[types.ManagedObjectReference]time.Time{vm: samples[len(samples)-1].Timestamp})
+
+	// Once written, the overlapped samples are skipped
+	samples, values = overlappedSamples(4, 6)
+	written = newSamples(values, samples, vcenter.lastSamples[vm])
+	if len(written) != 1 || written[0] != 6 {
+		t.Errorf("cycle after a successful write kept %v, expected sample 6", written)
+	}
+}
+
+func TestRollupSiblings(t *testing.T) {
+	vcenter := &VCenter{MetricGroups: []*MetricGroup{
+		{ObjectType: "VirtualMachine", Metrics: []MetricDef{
+			// The maximum listed first still shares the samples of the average
+			{Metric: "cpu.usage.maximum", Instances: "*", Key: 3},
+			{Metric: "cpu.usage.average", Instances: "*", Key: 2},
+			{Metric: "cpu.usage.minimum", Instances: "*", Key: 4},
+			// Other instances are another counter
+			{Metric: "cpu.usage.maximum", Instances: "", Key: 3},
+			// The none rollup is preferred to the average
+			{Metric: "mem.usage.average", Instances: "", Key: 24},
+			{Metric: "mem.usage.none", Instances: "", Key: 23},
+			{Metric: "mem.usage.latest", Instances: "", Key: 26},
+			// Without a none or average rollup, nothing is shared
+			{Metric: "disk.maxTotalLatency.latest", Instances: "", Key: 130},
+			{Metric: "disk.maxTotalLatency.maximum", Instances: "", Key: 131},
+		}},
+		{ObjectType: "HostSystem", Metrics: []MetricDef{
+			{Metric: "cpu.ready.summation", Instances: "", Key: 12},
+			{Metric: "cpu.ready.average", Instances: "", Key: 13},
+		}},
+	}}
+	siblings, shared, unsourced := vcenter.rollupSiblings()
+
+	expected := map[metricKey][]int32{
+		{ObjectType: "VirtualMachine", Key: 2}:  {3, 4},
+		{ObjectType: "VirtualMachine", Key: 23}: {24},
+	}
+	if len(siblings) != len(expected) {
+		t.Errorf("siblings = %v, expected %v", siblings, expected)
+	}
+	for primary, keys := range expected {
+		if fmt.Sprint(siblings[primary]) != fmt.Sprint(keys) {
+			t.Errorf("siblings of %v = %v, expected %v", primary, siblings[primary], keys)
+		}
+	}
+	for _, key := range []metricKey{{"VirtualMachine", 3}, {"VirtualMachine", 4}, {"VirtualMachine", 24}} {
+		if !shared[key] {
+			t.Errorf("%v is queried, expected it to be shared", key)
+		}
+	}
+	for _, key := range []metricKey{{"VirtualMachine", 2}, {"VirtualMachine", 23}, {"VirtualMachine", 26}, {"VirtualMachine", 130}, {"VirtualMachine", 131}, {"HostSystem", 12}, {"HostSystem", 13}} {
+		if shared[key] {
+			t.Errorf("%v is shared, expected it to be queried", key)
+		}
+	}
+	if strings.Join(unsourced, ",") != "VirtualMachine disk.maxTotalLatency" {
+		t.Errorf("unsourced = %q, expected the disk.maxTotalLatency counter", unsourced)
+	}
+}
+
+func TestShareRollups(t *testing.T) {
+	siblings := map[metricKey][]int32{{ObjectType: "VirtualMachine", Key: 2}: {3, 4}}
+	average := &types.PerfMetricIntSeries{PerfMetricSeries: types.PerfMetricSeries{Id: types.PerfMetricId{CounterId: 2, Instance: "0"}}, Value: []int64{10, 20}}
+	other := &types.PerfMetricIntSeries{PerfMetricSeries: types.PerfMetricSeries{Id: types.PerfMetricId{CounterId: 24}}, Value: []int64{5}}
+
+	series := shareRollups([]types.BasePerfMetricSeries{average, other}, "VirtualMachine", siblings)
+	if len(series) != 4 {
+		t.Fatalf("shareRollups returned %d series, expected 4", len(series))
+	}
+	for i, key := range []int32{3, 4} {
+		sibling := series[2+i].(*types.PerfMetricIntSeries)
+		if sibling.Id.CounterId != key || sibling.Id.Instance != "0" || fmt.Sprint(sibling.Value) != "[10 20]" {
+			t.Errorf("sibling %d = %+v, expected counter %d with the samples of the average", i, sibling, key)
+		}
+		sibling.Value[0] = -1
+	}
+	if average.Value[0] != 10 || series[3].(*types.PerfMetricIntSeries).Value[0] != -1 {
+		t.Error("the shared series have the same samples array")
+	}
+	if shared := shareRollups([]types.BasePerfMetricSeries{average}, "HostSystem", siblings); len(shared) != 1 {
+		t.Errorf("shareRollups shared %d series of another object type", len(shared)-1)
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRotationFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-influxdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "collector.log")
+	// A non-empty directory in place of the backup makes the rename fail
+	os.MkdirAll(filepath.Join(path+".1", "busy"), 0755)
+
+	rotating, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotating.Close()
+
+	var errs int
+	for _, line := range []string{"line one\n", "two\n", "three\n"} {
+		n, err := rotating.Write([]byte(line))
+		if n != len(line) {
+			t.Errorf("wrote %d bytes of %q", n, line)
+		}
+		if err != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("%d errors returned, expected the failed rotation once", errs)
+	}
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != "line one\ntwo\nthree\n" {
+		t.Errorf("log file = %q, expected every line", content)
+	}
+}
+
+func TestCollectorStatusEntities(t *testing.T) {
+	status := NewCollectorStatus()
+	status.Entities["Datastore"] = 3
+	fields := status.Fields()
+	if fields["entities_datastore"] != int64(3) {
+		t.Errorf("entities_datastore = %v, expected 3", fields["entities_datastore"])
+	}
+	if fields["entities_storagepod"] != int64(0) {
+		t.Errorf("entities_storagepod = %v, expected 0 when none were collected", fields["entities_storagepod"])
+	}
+}
+
+func TestInfluxDBPingAcceptsSuccessStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNoContent, http.StatusUnauthorized} {
+		influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Influxdb-Version", "1.8.10")
+			w.WriteHeader(status)
+		}))
+		output, err := NewInfluxDBOutput(InfluxDB{Hostname: influx.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err := output.Ping(time.Second)
+		influx.Close()
+		if status/100 == 2 && (err != nil || version != "1.8.10") {
+			t.Errorf("ping answered %d: version %q, error %v", status, version, err)
+		}
+		if status/100 != 2 && err == nil {
+			t.Errorf("ping answered %d: expected an error", status)
+		}
+	}
+}